@@ -0,0 +1,55 @@
+package bridgekit
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// UpdateBridgeInfo sends the m.bridge and uk.half-shot.bridge (MSC2346) state events to the given room.
+// This is called on portal creation, and whenever the bridge re-sends the bridge info of all portals.
+func (m *BridgeKit[T]) UpdateBridgeInfo(ctx context.Context, room *matrix.Room) {
+	if room.MXID == "" {
+		zerolog.Ctx(ctx).Debug().Str("remote_id", room.RemotedID).Msg("Room has no MXID, not updating bridge info")
+		return
+	}
+
+	stateKey, content := m.getBridgeInfo(ctx, room)
+	if _, err := m.Bot.SendStateEvent(ctx, room.MXID, event.StateBridge, stateKey, content); err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("room_id", room.MXID).Msg("Failed to update m.bridge")
+	}
+	// TODO remove this once https://github.com/matrix-org/matrix-doc/pull/2346 is in spec
+	if _, err := m.Bot.SendStateEvent(ctx, room.MXID, event.StateHalfShotBridge, stateKey, content); err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("room_id", room.MXID).Msg("Failed to update uk.half-shot.bridge")
+	}
+}
+
+// getBridgeInfo returns the state key and content of the bridge info state events for the given room.
+func (m *BridgeKit[T]) getBridgeInfo(ctx context.Context, room *matrix.Room) (string, *event.BridgeEventContent) {
+	content := &event.BridgeEventContent{
+		BridgeBot: m.Bot.UserID,
+		Protocol: event.BridgeInfoSection{
+			ID:          m.localpart,
+			DisplayName: m.Name,
+			AvatarURL:   m.Bridge.Config.AppService.Bot.ParsedAvatar.CUString(),
+			ExternalURL: m.URL,
+		},
+		Channel: event.BridgeInfoSection{
+			ID:          room.RemotedID,
+			DisplayName: room.Name,
+		},
+	}
+	if room.PrivateChat {
+		content.BeeperRoomTypeV2 = "dm"
+	}
+
+	if customizer, ok := m.Connector.(BridgeInfoCustomizer); ok {
+		customizer.CustomizeBridgeInfo(ctx, room, content)
+	}
+
+	return fmt.Sprintf("%s://%s", m.localpart, content.Channel.ID), content
+}
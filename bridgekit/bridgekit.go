@@ -5,15 +5,22 @@ import (
 	_ "embed"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/dvcrn/matrix-bridgekit/database"
 	"github.com/dvcrn/matrix-bridgekit/matrix"
+	"github.com/dvcrn/matrix-bridgekit/media"
+	"github.com/rs/zerolog"
 	"go.mau.fi/util/configupgrade"
+	"go.mau.fi/util/exzerolog"
 	"maunium.net/go/mautrix/appservice"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
@@ -32,6 +39,18 @@ type ConfigGetter interface {
 	Bridge() bridgeconfig.BridgeConfig
 }
 
+// PowerLevelConfigGetter can be implemented by the bridge config to configure the power levels of bridged rooms.
+// Embed matrix.PowerLevelPolicy in the config to make it configurable in the config file.
+type PowerLevelConfigGetter interface {
+	PowerLevelPolicy() matrix.PowerLevelPolicy
+}
+
+// MediaConfigGetter can be implemented by the bridge config to configure how remote media is downloaded.
+// Embed media.FetchConfig in the config to make it configurable in the config file.
+type MediaConfigGetter interface {
+	MediaFetchConfig() media.FetchConfig
+}
+
 type BridgeKit[T ConfigGetter] struct {
 	bridge.Bridge
 	localpart     string
@@ -42,6 +61,39 @@ type BridgeKit[T ConfigGetter] struct {
 	GhostMaster *matrix.GhostMaster
 	RoomManager *matrix.RoomManager
 	Connector   BridgeConnector
+	// Store persists rooms, ghosts and users. Defaults to the bridge database if not set before Init.
+	Store Store
+	// MaxDownloadSize is the maximum size in bytes of Matrix media that DownloadMatrixMedia accepts.
+	// Defaults to the upload size limit of the homeserver.
+	MaxDownloadSize int64
+	// Reconnect controls the backoff of remote sessions when the connector implements UserConnector.
+	Reconnect ReconnectConfig
+	// ShutdownTimeout is how long Stop waits for in-flight Matrix events and sends before abandoning them.
+	// Defaults to 15 seconds.
+	ShutdownTimeout time.Duration
+	// SendQueue controls the retries of sends queued with QueueSend.
+	SendQueue SendQueueConfig
+	// MediaFetcher downloads remote media, like ghost and room avatars. It's configured in Init
+	// from the bridge config if it implements MediaConfigGetter.
+	MediaFetcher *media.Fetcher
+
+	log       zerolog.Logger
+	usersLock sync.Mutex
+	users     map[id.UserID]*matrix.User
+
+	bridgeStatesLock sync.Mutex
+	bridgeStates     map[id.UserID]status.BridgeState
+
+	sessionsLock sync.Mutex
+	sessions     map[id.UserID]*userSession
+
+	sendQueuesLock sync.Mutex
+	sendQueues     map[id.RoomID]*sendQueue
+
+	reactionLocksLock sync.Mutex
+	reactionLocks     map[reactionKey]*reactionLock
+
+	inFlight *inFlightTracker
 
 	parentCtx       context.Context
 	parentCtxCancel context.CancelFunc
@@ -53,21 +105,26 @@ func (m *BridgeKit[T]) HandleMatrixEvent(room *matrix.Room, user bridge.User, ev
 }
 
 func (m *BridgeKit[T]) HandleMarkEncrypted(room *matrix.Room) {
+	if err := m.Store.PutRoom(m.parentCtx, room); err != nil {
+		m.log.Err(err).Stringer("room_id", room.MXID).Msg("Failed to save encrypted room")
+	}
+
 	if roomEventHandler, ok := m.Connector.(MatrixRoomEventHandler); ok {
-		err := roomEventHandler.HandleMatrixMarkEncrypted(m.parentCtx, room)
+		done, ok := m.inFlight.start(workMatrixEvent)
+		if !ok {
+			return
+		}
+		defer done()
+
+		err := roomEventHandler.HandleMatrixMarkEncrypted(withInFlight(m.parentCtx), room)
 		if err != nil {
-			fmt.Println("Error handling MarkEncrypted event: ", err)
+			m.log.Err(err).Stringer("room_id", room.MXID).Msg("Failed to handle MarkEncrypted event")
 		}
 
 		return
 	}
 }
 
-func (m *BridgeKit[T]) UpdateBridgeInfo(ctx context.Context) {
-	//TODO implement me
-	panic("implement me")
-}
-
 // GetExampleConfig returns the example configuration for the BridgeKit.
 func (m *BridgeKit[T]) GetExampleConfig() string {
 	return m.exampleConfig
@@ -75,100 +132,323 @@ func (m *BridgeKit[T]) GetExampleConfig() string {
 
 // GetConfigPtr returns a pointer to the configuration object associated with the BridgeKit.
 func (m *BridgeKit[T]) GetConfigPtr() interface{} {
-	fmt.Println("GetConfigPTR PTR")
 	return m.Config.GetPtr(&m.Bridge.Config)
 }
 
 // Init initializes the BridgeKit, including the Connector, GhostMaster, RoomManager, and CommandProcessor.
 func (m *BridgeKit[T]) Init() {
-	fmt.Println("[Init]")
+	m.log = m.ZLog.With().Str("component", "bridgekit").Logger()
+	m.parentCtx = m.log.WithContext(m.parentCtx)
+
+	if m.Store == nil {
+		m.Store = database.New(m.Bridge.DB)
+	}
+
 	if err := m.Connector.Init(m.parentCtx); err != nil {
-		fmt.Println("Error initializing connector: ", err)
+		m.log.Err(err).Msg("Failed to initialize connector")
 		return
 	}
 
-	m.GhostMaster = matrix.NewGhostMaster(&m.Bridge, m.localpart)
+	m.MediaFetcher = m.newMediaFetcher()
+	m.GhostMaster = matrix.NewGhostMaster(&m.Bridge, m.localpart, m.Store)
+	m.GhostMaster.MediaFetcher = m.MediaFetcher
 	m.RoomManager = matrix.NewRoomManager(&m.Bridge, m.GhostMaster, m)
+	m.RoomManager.MediaFetcher = m.MediaFetcher
+	m.RoomManager.PowerLevelPolicy = m.basePowerLevelPolicy()
 
 	m.CommandProcessor = commands.NewProcessor(&m.Bridge)
 	proc := m.CommandProcessor.(*commands.Processor)
+	if _, ok := m.Connector.(LoginHandler); ok {
+		proc.AddHandlers(m.loginCommands()...)
+	}
 	proc.AddHandlers(
 		m.Commands...,
 	)
 }
 
+// newMediaFetcher creates the media fetcher from the bridge config, falling back to the defaults if the config is invalid.
+func (m *BridgeKit[T]) newMediaFetcher() *media.Fetcher {
+	var config media.FetchConfig
+	if getter, ok := any(m.Config).(MediaConfigGetter); ok {
+		config = getter.MediaFetchConfig()
+	}
+
+	fetcher, err := media.NewFetcher(config)
+	if err != nil {
+		m.log.Err(err).Msg("Invalid media config, using defaults")
+		fetcher = media.DefaultFetcher()
+	}
+
+	if preparer, ok := m.Connector.(MediaRequestPreparer); ok {
+		fetcher.PrepareRequest = preparer.PrepareMediaRequest
+	}
+
+	return fetcher
+}
+
 // Start initializes the BridgeKit and starts the connector.
 // It first waits for the websocket connection to be established,
-// then starts the connector
+// then starts the connector. The global bridge state is reported as STARTING and RUNNING around it.
 func (m *BridgeKit[T]) Start() {
-	fmt.Println("[Start]")
-
+	m.log.Debug().Msg("Waiting for websocket before starting connector")
 	m.WaitWebsocketConnected()
+	started := make(chan struct{})
+	go func() {
+		m.SendGlobalBridgeState(status.BridgeState{StateEvent: status.StateStarting}.Fill(nil))
+		<-started
+		m.SendGlobalBridgeState(status.BridgeState{StateEvent: status.StateRunning}.Fill(nil))
+	}()
+
 	m.Connector.Start(m.parentCtx)
+	close(started)
+
+	m.connectLoggedInUsers(m.parentCtx)
 }
 
 // Stop stops the BridgeKit and its underlying Connector.
+// New Matrix events are refused, and in-flight events and sends get up to ShutdownTimeout to finish.
+// Sends aren't retried past that timeout. Then the last bridge state of every user is flushed,
+// the bridge is reported as unreachable and the connector is stopped.
 func (m *BridgeKit[T]) Stop() {
-	fmt.Println("[Stop]")
+	m.shutdown()
+	if m.RoomManager != nil {
+		m.RoomManager.StopEventQueues()
+	}
+	m.sendGlobalBridgeStateOnce(status.StateBridgeUnreachable)
 	m.parentCtxCancel()
 	m.Connector.Stop()
 }
 
 func (m *BridgeKit[T]) GetIPortal(roomID id.RoomID) bridge.Portal {
-	room := m.Connector.GetRoom(m.parentCtx, roomID)
-	if room != nil {
-		m.RoomManager.LoadRoom(room)
+	room := m.GetRoom(m.parentCtx, roomID)
+	if room == nil {
+		return nil
 	}
 	return room
 }
 
 func (m *BridgeKit[T]) GetAllIPortals() []bridge.Portal {
-	fmt.Println("[GetAllIPortals]")
-	return m.Connector.GetAllRooms(m.parentCtx)
+	rooms := m.GetAllRooms(m.parentCtx)
+	portals := make([]bridge.Portal, len(rooms))
+	for i, room := range rooms {
+		portals[i] = room
+	}
+
+	return portals
 }
 
 func (m *BridgeKit[T]) GetIUser(id id.UserID, create bool) bridge.User {
-	fmt.Println("[GetIUser] ", id.String(), " create ", create)
-
-	u := m.Connector.GetUser(m.parentCtx, id, create)
-	if u != nil {
-		u.BridgeState = m.NewBridgeStateQueue(u)
-		u.SetManagementRoomHandler = m.SetManagementRoom
+	u := m.GetUser(m.parentCtx, id, create)
+	if u == nil {
+		return nil
 	}
-
 	return u
 }
 
 func (m *BridgeKit[T]) IsGhost(userID id.UserID) bool {
-	fmt.Println("[IsGhost] ", userID.String())
-	return m.Connector.IsGhost(m.parentCtx, userID)
+	if legacy, ok := m.Connector.(LegacyConnector); ok && legacy.IsGhost(m.parentCtx, userID) {
+		return true
+	}
+
+	return m.GhostMaster.IsGhostMXID(userID)
 }
 
 func (m *BridgeKit[T]) GetIGhost(userID id.UserID) bridge.Ghost {
-	fmt.Println("[GetIGhost] ", userID.String())
-	return m.Connector.GetGhost(m.parentCtx, userID)
+	ghost := m.GetGhost(m.parentCtx, userID)
+	if ghost == nil {
+		return nil
+	}
+	return ghost
 }
 
-func (m *BridgeKit[T]) CreatePrivatePortal(roomID id.RoomID, user bridge.User, ghost bridge.Ghost) {
-	fmt.Println("[CreatePrivatePortal] -- roomID: ", roomID.String(), " user: ", user.GetMXID().String())
-	//TODO implement me
-	panic("implement me")
+// GetRoom returns the stored room with the given Matrix room ID, or nil if there is no such room.
+func (m *BridgeKit[T]) GetRoom(ctx context.Context, roomID id.RoomID) *matrix.Room {
+	room, err := m.Store.GetRoomByMXID(ctx, roomID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("room_id", roomID).Msg("Failed to get room")
+		return nil
+	}
+
+	if legacy, ok := m.Connector.(LegacyConnector); ok && room == nil {
+		room = legacy.GetRoom(ctx, roomID)
+	}
+	if room != nil {
+		m.RoomManager.LoadRoom(room)
+	}
+
+	return room
 }
 
-func (m *BridgeKit[T]) handleMatrixRoomEvent(room *matrix.Room, user bridge.User, evt *event.Event) {
-	fmt.Println("[handleMatrixRoomEvent] ", room.Name, " evt: ", evt.Type)
+// GetRoomByRemoteID returns the stored room with the given remote ID, or nil if there is no such room.
+func (m *BridgeKit[T]) GetRoomByRemoteID(ctx context.Context, remoteID string) *matrix.Room {
+	room, err := m.Store.GetRoomByRemoteID(ctx, remoteID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("remote_id", remoteID).Msg("Failed to get room")
+		return nil
+	} else if room != nil {
+		m.RoomManager.LoadRoom(room)
+	}
 
-	// check if connector implements RoomEventHandler with type assertion
-	if roomEventHandler, ok := m.Connector.(MatrixRoomEventHandler); ok {
-		err := roomEventHandler.HandleMatrixRoomEvent(m.parentCtx, room, user, evt)
+	return room
+}
+
+// GetAllRooms returns all stored rooms, and the rooms of the connector if it still implements LegacyConnector.
+func (m *BridgeKit[T]) GetAllRooms(ctx context.Context) []*matrix.Room {
+	rooms, err := m.Store.GetAllRooms(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to get rooms")
+		return nil
+	}
+
+	if legacy, ok := m.Connector.(LegacyConnector); ok {
+		stored := make(map[id.RoomID]bool, len(rooms))
+		for _, room := range rooms {
+			stored[room.MXID] = true
+		}
+		for _, portal := range legacy.GetAllRooms(ctx) {
+			if room, ok := portal.(*matrix.Room); ok && !stored[room.MXID] {
+				rooms = append(rooms, room)
+			}
+		}
+	}
+
+	for _, room := range rooms {
+		m.RoomManager.LoadRoom(room)
+	}
+
+	return rooms
+}
+
+// SaveRoom persists the given room. New ghosts of the room are stored too, use SaveGhost to update existing ones.
+func (m *BridgeKit[T]) SaveRoom(ctx context.Context, room *matrix.Room) error {
+	return m.Store.PutRoom(ctx, room)
+}
+
+// GetGhost returns the ghost with the given ID. If the ghost isn't stored yet and the connector
+// implements GhostFetcher, the ghost gets fetched from the connector and stored.
+func (m *BridgeKit[T]) GetGhost(ctx context.Context, userID id.UserID) *matrix.Ghost {
+	if !m.GhostMaster.IsGhostMXID(userID) {
+		return nil
+	}
+
+	ghost, err := m.Store.GetGhostByMXID(ctx, userID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("user_id", userID).Msg("Failed to get ghost")
+		return nil
+	}
+
+	if legacy, ok := m.Connector.(LegacyConnector); ok && ghost == nil {
+		ghost = legacy.GetGhost(ctx, userID)
+	}
+
+	if ghost == nil {
+		fetcher, ok := m.Connector.(GhostFetcher)
+		if !ok {
+			return nil
+		}
+
+		ghost, err = fetcher.FetchGhost(ctx, userID)
 		if err != nil {
-			fmt.Println("Error handling room event: ", err)
+			zerolog.Ctx(ctx).Err(err).Stringer("user_id", userID).Msg("Failed to fetch ghost")
+			return nil
+		} else if ghost == nil {
+			return nil
 		}
 
-		return
+		if err := m.Store.PutGhost(ctx, ghost); err != nil {
+			zerolog.Ctx(ctx).Err(err).Stringer("user_id", userID).Msg("Failed to save ghost")
+		}
+	}
+
+	return m.GhostMaster.LoadGhost(ghost)
+}
+
+// SaveGhost persists the given ghost.
+func (m *BridgeKit[T]) SaveGhost(ctx context.Context, ghost *matrix.Ghost) error {
+	return m.Store.PutGhost(ctx, ghost)
+}
+
+// GetUser returns the user with the given ID. If create is true and the user isn't stored yet,
+// a new user is created, passed to the connector if it implements UserInitializer, and stored.
+// Users are cached, so state like the command state is kept between events.
+func (m *BridgeKit[T]) GetUser(ctx context.Context, userID id.UserID, create bool) *matrix.User {
+	m.usersLock.Lock()
+	user, ok := m.users[userID]
+	m.usersLock.Unlock()
+	if ok {
+		return user
+	}
+
+	// the lock isn't held while calling the store and connector, so that they can look up users themselves
+	user, isNew := m.loadUser(ctx, userID, create)
+	if user == nil {
+		return nil
+	}
+
+	m.usersLock.Lock()
+	if cached, ok := m.users[userID]; ok {
+		// another caller loaded the user in the meantime
+		m.usersLock.Unlock()
+		return cached
+	}
+	m.GhostMaster.LoadUser(user)
+	user.BridgeState = m.NewBridgeStateQueue(user)
+	user.SetManagementRoomHandler = m.SetManagementRoom
+	if checker, ok := m.Connector.(LoginChecker); ok {
+		user.IsLoggedInHandler = func(u *matrix.User) bool {
+			return checker.IsUserLoggedIn(m.parentCtx, u)
+		}
+	}
+	m.users[userID] = user
+	m.usersLock.Unlock()
+
+	if isNew {
+		if err := m.Store.PutUser(ctx, user); err != nil {
+			zerolog.Ctx(ctx).Err(err).Stringer("user_id", userID).Msg("Failed to save user")
+		}
+	}
+
+	return user
+}
+
+// loadUser gets the user from the store or the legacy connector, or creates a new one if create is true.
+// isNew is true if the user was created and still needs to be stored.
+func (m *BridgeKit[T]) loadUser(ctx context.Context, userID id.UserID, create bool) (user *matrix.User, isNew bool) {
+	user, err := m.Store.GetUserByMXID(ctx, userID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("user_id", userID).Msg("Failed to get user")
+		return nil, false
+	} else if user != nil {
+		return user, false
+	}
+
+	if legacy, ok := m.Connector.(LegacyConnector); ok {
+		if user = legacy.GetUser(ctx, userID, create); user != nil {
+			return user, false
+		}
+	}
+
+	if !create {
+		return nil, false
+	}
+
+	user = &matrix.User{
+		MXID:            userID,
+		PermissionLevel: bridgeconfig.PermissionLevelUser,
+	}
+	if initializer, ok := m.Connector.(UserInitializer); ok {
+		if err := initializer.InitUser(ctx, user); err != nil {
+			zerolog.Ctx(ctx).Err(err).Stringer("user_id", userID).Msg("Failed to initialize user")
+			return nil, false
+		}
 	}
 
-	fmt.Println("No room event handler")
+	return user, true
+}
+
+// SaveUser persists the given user.
+func (m *BridgeKit[T]) SaveUser(ctx context.Context, user *matrix.User) error {
+	return m.Store.PutUser(ctx, user)
 }
 
 // ReplyErrorMessage sends a notice message in the given room with the error message from the provided event.
@@ -186,26 +466,30 @@ func (m *BridgeKit[T]) ReplyErrorMessage(ctx context.Context, evt *event.Event,
 // MarkRead marks the given event as read in the specified Matrix room.
 // It uses the bot's intent to mark the event as read, indicating that the bridge has read the event.
 func (m *BridgeKit[T]) MarkBotRead(ctx context.Context, room *matrix.Room, evt *event.Event) error {
-	fmt.Println("Marking as read: ", evt.ID.String())
 	return m.Bot.MarkRead(ctx, room.MXID, evt.ID)
 }
 
-// ResetRoomPermission resets the power levels for a given room, setting the bridge bot's power level to 9001 and the main intent user's power level to 100.
+// ResetRoomPermission resets the power levels for a given room to the ones generated from the power level policy of the room.
+// The generated levels are merged into the current power levels, so levels of other Matrix users and events that
+// the policy doesn't mention are kept.
 //
 // ctx is the context to use for the operation.
 // room is the Matrix room to reset the permissions for.
 func (m *BridgeKit[T]) ResetRoomPermission(ctx context.Context, room *matrix.Room) (*mautrix.RespSendEvent, error) {
-	fmt.Println("[ResetRoomPermission] ", room.Name)
-
-	powerLevels := matrix.NewBasePowerLevels()
-	powerLevels.Users = map[id.UserID]int{
-		m.Bridge.Bot.UserID: 9001,
+	powerLevels, err := m.Bridge.Bot.PowerLevels(ctx, room.MXID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get power levels: %w", err)
 	}
 
-	for _, ghost := range room.Ghosts {
-		powerLevels.Users[ghost.MXID] = 100
+	users, err := m.bridgedRoomUsers(ctx, room)
+	if err != nil {
+		return nil, err
 	}
 
+	generated := m.GetPowerLevelPolicy(ctx, room).PowerLevels(m.Bridge.Bot.UserID, room, users...)
+	managed := append(room.GhostUserIDs(), users...)
+	mergePowerLevels(powerLevels, generated, m.Bridge.Bot.UserID, managed)
+
 	resp, err := m.Bridge.Bot.SetPowerLevels(ctx, room.MXID, powerLevels)
 	if err != nil {
 		return nil, err
@@ -215,24 +499,10 @@ func (m *BridgeKit[T]) ResetRoomPermission(ctx context.Context, room *matrix.Roo
 }
 
 // MarkRoomReadOnly sets the power levels in the given Matrix room to effectively make it read-only for the current user.
-// This is done by setting the default power level to 101 and disabling reactions and messages for all users except the ghost and bot.
+// This is done by raising the level needed for messages and reactions to the ReadOnly level of the power level policy,
+// which only the bot and ghosts have.
 func (m *BridgeKit[T]) MarkRoomReadOnly(ctx context.Context, room *matrix.Room) (*mautrix.RespSendEvent, error) {
-	fmt.Println("[MarkRoomReadOnly] ", room.Name)
-
-	// set everyone to 100 except the current user, effectively takinga way his permission to do anything
-	powerLevels := matrix.NewBasePowerLevels()
-	powerLevels.Users = map[id.UserID]int{
-		m.Bridge.Bot.UserID: 9001,
-	}
-
-	for _, ghost := range room.Ghosts {
-		powerLevels.Users[ghost.MXID] = 102
-	}
-
-	// disable messages
-	powerLevels.EventsDefault = 101
-	powerLevels.Events[event.EventReaction.Type] = 101
-	powerLevels.Events[event.EventMessage.Type] = 101
+	powerLevels := m.GetPowerLevelPolicy(ctx, room).ReadOnlyPowerLevels(m.Bridge.Bot.UserID, room)
 
 	resp, err := m.Bridge.Bot.SetPowerLevels(ctx, room.MXID, powerLevels)
 	if err != nil {
@@ -244,24 +514,23 @@ func (m *BridgeKit[T]) MarkRoomReadOnly(ctx context.Context, room *matrix.Room)
 
 // CreateRoom creates a new Matrix room for the given portal and user. It invites the bot and the user to the room,
 // sets the appropriate power levels, and updates the portal's MXID with the new room ID. It also updates the display names of any ghost users associated with the portal.
+// The portal needs a RemotedID, as rooms are stored by it. If the room was created but couldn't be saved,
+// the room is returned together with the error.
 func (m *BridgeKit[T]) CreateRoom(ctx context.Context, portal *matrix.Room, user *matrix.User, avatarURL id.ContentURI) (*matrix.Room, *mautrix.RespCreateRoom, error) {
+	if portal.RemotedID == "" {
+		return nil, nil, database.ErrNoRemoteID
+	}
+
 	userIdsToInvite := []id.UserID{
 		m.Bot.UserID,
 		user.MXID,
 	}
 	userIdsToInvite = append(userIdsToInvite, portal.GhostUserIDs()...)
 
-	fmt.Println("Creating room with ids: ", userIdsToInvite)
+	log := zerolog.Ctx(ctx).With().Str("room_name", portal.Name).Logger()
+	log.Debug().Array("invite", exzerolog.ArrayOfStringers(userIdsToInvite)).Msg("Creating room")
 
-	powerLevels := matrix.NewBasePowerLevels()
-	powerLevels.Users = map[id.UserID]int{
-		m.Bridge.Bot.UserID: 9001,
-	}
-
-	// set every ghost as normal power level
-	for _, ghost := range portal.Ghosts {
-		powerLevels.Users[ghost.GetMXID()] = 100
-	}
+	powerLevels := m.GetPowerLevelPolicy(ctx, portal).PowerLevels(m.Bridge.Bot.UserID, portal, user.MXID)
 
 	initialState := []*event.Event{{
 		Type:    event.StatePowerLevels,
@@ -269,7 +538,6 @@ func (m *BridgeKit[T]) CreateRoom(ctx context.Context, portal *matrix.Room, user
 	}}
 
 	if m.Config.Bridge().GetEncryptionConfig().Default {
-		fmt.Println("encryption is enabled, setting encryption event")
 		evt := &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1}
 		if rot := m.Config.Bridge().GetEncryptionConfig().Rotation; rot.EnableCustom {
 			evt.RotationPeriodMillis = rot.Milliseconds
@@ -285,6 +553,17 @@ func (m *BridgeKit[T]) CreateRoom(ctx context.Context, portal *matrix.Room, user
 		portal.Encrypted = true
 	}
 
+	bridgeInfoStateKey, bridgeInfo := m.getBridgeInfo(ctx, portal)
+	initialState = append(initialState, &event.Event{
+		Type:     event.StateBridge,
+		StateKey: &bridgeInfoStateKey,
+		Content:  event.Content{Parsed: bridgeInfo},
+	}, &event.Event{
+		Type:     event.StateHalfShotBridge,
+		StateKey: &bridgeInfoStateKey,
+		Content:  event.Content{Parsed: bridgeInfo},
+	})
+
 	if !avatarURL.IsEmpty() {
 		initialState = append(initialState, &event.Event{
 			Type: event.StateRoomAvatar,
@@ -321,23 +600,30 @@ func (m *BridgeKit[T]) CreateRoom(ctx context.Context, portal *matrix.Room, user
 
 	room, err := m.Bridge.Bot.CreateRoom(ctx, req)
 	if err != nil {
-		fmt.Println("Error creating room: ", err)
+		log.Err(err).Msg("Failed to create room")
 		return nil, nil, err
 	}
 
-	fmt.Println("created room!! ", req.Name)
+	log.Info().Stringer("room_id", room.RoomID).Msg("Created room")
 	portal.MXID = room.RoomID
+	if err := m.Store.PutRoom(ctx, portal); err != nil {
+		log.Err(err).Msg("Failed to save room")
+		return portal, room, fmt.Errorf("failed to save room: %w", err)
+	}
 
 	// also invite the user
 	if err := m.RoomManager.AddUserToRoom(ctx, room.RoomID, user); err != nil {
-		fmt.Println("Err adding user to room: ", err)
+		log.Err(err).Msg("Failed to add user to room")
 	}
 
 	for _, ghost := range portal.Ghosts {
-		if err := m.GhostMaster.UpdateGhostName(ctx, ghost, ghost.GetDisplayname()); err != nil {
-			fmt.Println("Error updating ghost name: ", err)
-		} else {
-			fmt.Println("Updated ghost name: ", ghost.GetDisplayname())
+		// the ghosts of the portal may be new structs, so use the stored ghost to skip names that are already set
+		stored := m.GetGhost(ctx, ghost.MXID)
+		if stored == nil {
+			stored = ghost
+		}
+		if err := m.GhostMaster.UpdateGhostName(ctx, stored, ghost.GetDisplayname()); err != nil {
+			log.Err(err).Stringer("ghost_mxid", ghost.MXID).Msg("Failed to update ghost name")
 		}
 	}
 
@@ -357,10 +643,19 @@ func (m *BridgeKit[T]) SendTimestampedBotMessageInRoom(ctx context.Context, room
 }
 
 // BackfillMessages backfills a list of messages into the given Matrix room. If the Beeper feature for batch sending is supported, it will use that to send the messages in a single request. Otherwise, it will send each message individually.
+// Messages with a RemoteID get their event IDs recorded, see GetMessageByRemoteID.
 //
 // The `notify` parameter controls whether a notification should be sent for the backfilled messages.
 // If `notify` is set to `true`, messages will not be marked as read
 func (m *BridgeKit[T]) BackfillMessages(ctx context.Context, room *matrix.Room, user *matrix.User, msgs []*matrix.Message, notify bool) error {
+	defer m.trackWork(workBackfill)()
+
+	log := zerolog.Ctx(ctx).With().
+		Stringer("room_id", room.MXID).
+		Stringer("user_id", user.MXID).
+		Int("message_count", len(msgs)).
+		Logger()
+	ctx = log.WithContext(ctx)
 	batchSending := m.SpecVersions.Supports(mautrix.BeeperFeatureBatchSending)
 
 	// msgContent := format.RenderMarkdown(text, true, false)
@@ -370,7 +665,7 @@ func (m *BridgeKit[T]) BackfillMessages(ctx context.Context, room *matrix.Room,
 			Parsed: msg.Content,
 		}
 
-		if user.DoublePuppetIntent != nil {
+		if user.CustomIntent() != nil {
 			m.Bridge.Bot.AddDoublePuppetValue(&content)
 		}
 
@@ -385,7 +680,6 @@ func (m *BridgeKit[T]) BackfillMessages(ctx context.Context, room *matrix.Room,
 	}
 
 	if batchSending {
-		fmt.Println("Beeper batch sending enabled")
 		req := &mautrix.ReqBeeperBatchSend{
 			ForwardIfNoMessages: true,
 			Forward:             true,
@@ -396,11 +690,19 @@ func (m *BridgeKit[T]) BackfillMessages(ctx context.Context, room *matrix.Room,
 			req.MarkReadBy = user.MXID
 		}
 
-		_, err := m.Bridge.Bot.BeeperBatchSend(ctx, room.MXID, req)
+		resp, err := m.Bridge.Bot.BeeperBatchSend(ctx, room.MXID, req)
 		if err != nil {
-			fmt.Println("Error backfilling message: ", err)
+			log.Err(err).Msg("Failed to batch send backfill, falling back to sending messages individually")
 			goto manualBackfill
-			return err
+		}
+
+		for i, eventID := range resp.EventIDs {
+			if i >= len(msgs) || msgs[i].RemoteID == "" {
+				continue
+			}
+			if err := m.MapMessage(ctx, room, msgs[i].RemoteID, msgs[i].PartIndex, eventID, msgs[i].FromMXID, msgs[i].Timestamp); err != nil {
+				log.Err(err).Str("remote_id", msgs[i].RemoteID).Msg("Failed to save message mapping")
+			}
 		}
 
 		return nil
@@ -413,9 +715,8 @@ manualBackfill:
 			intent = m.GhostMaster.AsUserGhost(ctx, user)
 		}
 
-		_, err := m.SendTimestampedMainMessageInRoom(ctx, room, intent, msg.Content, msg.Timestamp)
-		if err != nil {
-			fmt.Println("err while inserting message: ", err.Error())
+		if _, err := m.SendRemoteMessageInRoom(ctx, room, intent, msg); err != nil {
+			log.Err(err).Str("remote_id", msg.RemoteID).Msg("Failed to backfill message")
 		}
 	}
 
@@ -424,13 +725,15 @@ manualBackfill:
 
 // SendTimestampedMainMessageInRoom sends a message event with the given content and timestamp to the specified room, using the provided sender intent
 func (m *BridgeKit[T]) SendTimestampedMainMessageInRoom(ctx context.Context, room *matrix.Room, sender *appservice.IntentAPI, content event.MessageEventContent, ts int64) (*mautrix.RespSendEvent, error) {
+	defer m.trackWork(workSend)()
+
 	if sender == nil {
 		return nil, errors.New("no sender intent passed")
 	}
 
 	resp, err := sender.SendMassagedMessageEvent(ctx, room.MXID, event.EventMessage, content, ts)
 	if err != nil {
-		fmt.Println("Error sending message: ", err)
+		zerolog.Ctx(ctx).Err(err).Stringer("room_id", room.MXID).Msg("Failed to send message")
 		return nil, err
 	}
 
@@ -439,9 +742,11 @@ func (m *BridgeKit[T]) SendTimestampedMainMessageInRoom(ctx context.Context, roo
 
 // SendTimestampedUserMessageInRoom sends a message event with the given content and timestamp from the specified user in the given room.
 func (m *BridgeKit[T]) SendTimestampedUserMessageInRoom(ctx context.Context, room *matrix.Room, user *matrix.User, content *event.MessageEventContent, ts int64) (*mautrix.RespSendEvent, error) {
+	defer m.trackWork(workSend)()
+
 	resp, err := m.GhostMaster.AsUserGhost(ctx, user).SendMassagedMessageEvent(ctx, room.MXID, event.EventMessage, content, ts)
 	if err != nil {
-		fmt.Println("Error sending message: ", err)
+		zerolog.Ctx(ctx).Err(err).Stringer("room_id", room.MXID).Msg("Failed to send message")
 		return nil, err
 	}
 
@@ -451,9 +756,11 @@ func (m *BridgeKit[T]) SendTimestampedUserMessageInRoom(ctx context.Context, roo
 // SendUserMessageInRoom sends a message event from the given user to the given room.
 // The content of the message is specified by the provided MessageEventContent.
 func (m *BridgeKit[T]) SendUserMessageInRoom(ctx context.Context, room *matrix.Room, user *matrix.User, content *event.MessageEventContent) (*mautrix.RespSendEvent, error) {
+	defer m.trackWork(workSend)()
+
 	resp, err := m.GhostMaster.AsUserGhost(ctx, user).SendMessageEvent(ctx, room.MXID, event.EventMessage, content)
 	if err != nil {
-		fmt.Println("Error sending message: ", err)
+		zerolog.Ctx(ctx).Err(err).Stringer("room_id", room.MXID).Msg("Failed to send message")
 		return nil, err
 	}
 
@@ -462,13 +769,15 @@ func (m *BridgeKit[T]) SendUserMessageInRoom(ctx context.Context, room *matrix.R
 
 // SendTimestampedMessageInRoom sends a message event with the given timestamp to the specified Matrix room, using the provided sender intent.
 func (m *BridgeKit[T]) SendTimestampedMessageInRoom(ctx context.Context, room *matrix.Room, sender *appservice.IntentAPI, content *event.MessageEventContent, ts int64) (*mautrix.RespSendEvent, error) {
+	defer m.trackWork(workSend)()
+
 	if sender == nil {
 		return nil, errors.New("no sender intent passed")
 	}
 
 	resp, err := sender.SendMassagedMessageEvent(ctx, room.MXID, event.EventMessage, content, ts)
 	if err != nil {
-		fmt.Println("Error sending message: ", err)
+		zerolog.Ctx(ctx).Err(err).Stringer("room_id", room.MXID).Msg("Failed to send message")
 		return nil, err
 	}
 
@@ -477,13 +786,15 @@ func (m *BridgeKit[T]) SendTimestampedMessageInRoom(ctx context.Context, room *m
 
 // SendMessageInRoom sends a message event to the given Matrix room using the provided sender.
 func (m *BridgeKit[T]) SendMessageInRoom(ctx context.Context, room *matrix.Room, sender *appservice.IntentAPI, content *event.MessageEventContent) (*mautrix.RespSendEvent, error) {
+	defer m.trackWork(workSend)()
+
 	if sender == nil {
 		return nil, errors.New("no sender intent passed")
 	}
 
 	resp, err := sender.SendMessageEvent(ctx, room.MXID, event.EventMessage, content)
 	if err != nil {
-		fmt.Println("Error sending message: ", err)
+		zerolog.Ctx(ctx).Err(err).Stringer("room_id", room.MXID).Msg("Failed to send message")
 		return nil, err
 	}
 
@@ -497,14 +808,16 @@ func (m *BridgeKit[T]) RegisterCommand(cmd commands.Handler) {
 
 // StartBridgeConnector sets the given bridge connector and starts the event loop
 func (m *BridgeKit[T]) StartBridgeConnector(ctx context.Context, connector BridgeConnector) {
-	fmt.Println("[StartBridgeConnector] ")
 	m.Connector = connector
 	m.parentCtx, m.parentCtxCancel = context.WithCancel(ctx)
 	m.Main()
 }
 
 func (m *BridgeKit[T]) SetManagementRoom(user *matrix.User, room id.RoomID) {
-	fmt.Println("SetManagementRoom - ", user.DisplayName, room)
+	user.ManagementRoomID = room
+	if err := m.Store.PutUser(m.parentCtx, user); err != nil {
+		m.log.Err(err).Stringer("user_id", user.MXID).Msg("Failed to save management room")
+	}
 	m.Connector.SetManagementRoom(m.parentCtx, user, room)
 }
 
@@ -530,6 +843,12 @@ func NewBridgeKit[T ConfigGetter](
 		localpart:     localpart,
 		Config:        conf,
 		exampleConfig: exampleConfig,
+		users:         make(map[id.UserID]*matrix.User),
+		bridgeStates:  make(map[id.UserID]status.BridgeState),
+		sessions:      make(map[id.UserID]*userSession),
+		sendQueues:    make(map[id.RoomID]*sendQueue),
+		reactionLocks: make(map[reactionKey]*reactionLock),
+		inFlight:      newInFlightTracker(),
 	}
 	br.Bridge = bridge.Bridge{
 		Name:        name,
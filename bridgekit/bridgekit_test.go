@@ -0,0 +1,250 @@
+package bridgekit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dvcrn/matrix-bridgekit/database"
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/configupgrade"
+	"go.mau.fi/util/dbutil"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type testConfig struct{}
+
+func (testConfig) DoUpgrade(configupgrade.Helper)      {}
+func (testConfig) GetPtr(*bridgeconfig.BaseConfig) any { return nil }
+func (testConfig) Bridge() bridgeconfig.BridgeConfig   { return testBridgeConfig{} }
+
+// testBridgeConfig implements the parts of BridgeConfig that the tests need, calling any other method panics.
+type testBridgeConfig struct {
+	bridgeconfig.BridgeConfig
+}
+
+func (testBridgeConfig) GetEncryptionConfig() bridgeconfig.EncryptionConfig {
+	return bridgeconfig.EncryptionConfig{}
+}
+
+// testStore implements the parts of Store that the tests need, calling any other method panics.
+type testStore struct {
+	Store
+
+	lock    sync.Mutex
+	userIDs []id.UserID
+	puts    map[id.UserID]matrix.LoginState
+}
+
+func (s *testStore) GetAllUserIDs(ctx context.Context) ([]id.UserID, error) {
+	return s.userIDs, nil
+}
+
+func (s *testStore) PutUser(ctx context.Context, user *matrix.User) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.puts == nil {
+		s.puts = make(map[id.UserID]matrix.LoginState)
+	}
+	s.puts[user.MXID] = user.LoginState
+	return nil
+}
+
+// testConnector is a BridgeConnector that does nothing.
+type testConnector struct{}
+
+func (testConnector) Init(ctx context.Context) error                                             { return nil }
+func (testConnector) Start(ctx context.Context)                                                  {}
+func (testConnector) Stop()                                                                      {}
+func (testConnector) SetManagementRoom(ctx context.Context, user *matrix.User, roomID id.RoomID) {}
+
+// newTestBridgeKit returns a BridgeKit that isn't connected to a homeserver. Cached users don't have a bridge
+// state queue, so reporting their state only updates the state that GetUserBridgeState returns.
+func newTestBridgeKit(t *testing.T, connector BridgeConnector, users ...*matrix.User) *BridgeKit[testConfig] {
+	t.Helper()
+
+	m := NewBridgeKit("test", "test", "", "", "", testConfig{}, "")
+	m.Connector = connector
+	m.Store = &testStore{}
+	m.log = zerolog.Nop()
+	m.parentCtx, m.parentCtxCancel = context.WithCancel(context.Background())
+	t.Cleanup(m.parentCtxCancel)
+
+	for _, user := range users {
+		m.users[user.MXID] = user
+	}
+
+	return m
+}
+
+// testHomeserver answers every request with an empty object, except for room creation and sent events, and records
+// the profile changes and events it receives.
+type testHomeserver struct {
+	lock     sync.Mutex
+	profiles []string
+	sends    []string
+}
+
+func (hs *testHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	switch {
+	case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/profile/"):
+		hs.profiles = append(hs.profiles, r.URL.Path)
+	case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/send/"):
+		hs.sends = append(hs.sends, r.URL.Path)
+		_ = json.NewEncoder(w).Encode(map[string]string{"event_id": fmt.Sprintf("$event%d", len(hs.sends))})
+		return
+	case strings.HasSuffix(r.URL.Path, "/createRoom"):
+		_ = json.NewEncoder(w).Encode(map[string]string{"room_id": "!portal:example.com"})
+		return
+	}
+
+	_, _ = w.Write([]byte("{}"))
+}
+
+// newTestHomeserverBridgeKit returns a BridgeKit that talks to the given homeserver and stores everything in an
+// in-memory SQLite database.
+func newTestHomeserverBridgeKit(t *testing.T, hs http.Handler) *BridgeKit[testConfig] {
+	t.Helper()
+
+	server := httptest.NewServer(hs)
+	t.Cleanup(server.Close)
+
+	m := newTestBridgeKit(t, testConnector{})
+	m.Bridge.ZLog = &m.log
+	m.Bridge.Config.Homeserver.Domain = "example.com"
+	m.Bridge.Config.Bridge = m.Config.Bridge()
+
+	as, err := appservice.CreateFull(appservice.CreateOpts{
+		Registration:     &appservice.Registration{AppToken: "as_token", SenderLocalpart: "bot"},
+		HomeserverDomain: "example.com",
+		HomeserverURL:    server.URL,
+	})
+	if err != nil {
+		t.Fatalf("failed to create appservice: %v", err)
+	}
+	m.AS = as
+	m.Bot = as.BotIntent()
+
+	rawDB, err := sql.Open("sqlite3", ":memory:?_foreign_keys=on")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	// every connection to :memory: gets its own database
+	rawDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = rawDB.Close() })
+
+	db, err := dbutil.NewWithDB(rawDB, "sqlite3")
+	if err != nil {
+		t.Fatalf("failed to wrap database: %v", err)
+	}
+	store := database.New(db)
+	if err := store.Upgrade(context.Background()); err != nil {
+		t.Fatalf("failed to upgrade database: %v", err)
+	}
+
+	m.Store = store
+	m.GhostMaster = matrix.NewGhostMaster(&m.Bridge, m.localpart, m.Store)
+	m.RoomManager = matrix.NewRoomManager(&m.Bridge, m.GhostMaster, m)
+
+	return m
+}
+
+func TestCreateRoomSkipsSyncedGhostNames(t *testing.T) {
+	hs := &testHomeserver{}
+	m := newTestHomeserverBridgeKit(t, hs)
+	ctx := context.Background()
+
+	synced := []*matrix.Ghost{
+		{MXID: "@test_alice:example.com", RemoteID: "alice", DisplayName: "Alice", NameSet: true},
+		{MXID: "@test_bob:example.com", RemoteID: "bob", DisplayName: "Bob", NameSet: true},
+	}
+	for _, ghost := range synced {
+		if err := m.Store.PutGhost(ctx, ghost); err != nil {
+			t.Fatalf("failed to store ghost: %v", err)
+		}
+	}
+
+	// the connector builds new structs for the ghosts of the portal, which don't know that the name is set
+	portal := m.RoomManager.NewRoom("Portal", "",
+		&matrix.Ghost{MXID: "@test_alice:example.com", RemoteID: "alice", DisplayName: "Alice"},
+		&matrix.Ghost{MXID: "@test_bob:example.com", RemoteID: "bob", DisplayName: "Robert"},
+	)
+	portal.RemotedID = "portal"
+
+	if _, _, err := m.CreateRoom(ctx, portal, &matrix.User{MXID: "@user:example.com"}, id.ContentURI{}); err != nil {
+		t.Fatalf("failed to create room: %v", err)
+	}
+
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if len(hs.profiles) != 1 || !strings.Contains(hs.profiles[0], "test_bob") {
+		t.Fatalf("expected only the renamed ghost to get a profile update, got %v", hs.profiles)
+	}
+
+	stored, err := m.Store.GetGhostByMXID(ctx, "@test_bob:example.com")
+	if err != nil {
+		t.Fatalf("failed to get ghost: %v", err)
+	} else if stored.DisplayName != "Robert" || !stored.NameSet {
+		t.Fatalf("expected the new name to be stored, got %q (set: %t)", stored.DisplayName, stored.NameSet)
+	}
+}
+
+// testEncryptionConnector records whether rooms were already marked as encrypted when the connector is told about it.
+type testEncryptionConnector struct {
+	testConnector
+
+	encrypted bool
+}
+
+func (c *testEncryptionConnector) HandleMatrixRoomEvent(ctx context.Context, room *matrix.Room, user bridge.User, evt *event.Event) error {
+	return nil
+}
+
+func (c *testEncryptionConnector) HandleMatrixMarkEncrypted(ctx context.Context, room *matrix.Room) error {
+	c.encrypted = room.Encrypted
+	return nil
+}
+
+func TestMarkEncryptedSavesRoom(t *testing.T) {
+	m := newTestHomeserverBridgeKit(t, &testHomeserver{})
+	connector := &testEncryptionConnector{}
+	m.Connector = connector
+	ctx := context.Background()
+
+	room := m.RoomManager.NewRoom("Portal", "")
+	room.RemotedID = "portal"
+	room.MXID = "!portal:example.com"
+	if err := m.Store.PutRoom(ctx, room); err != nil {
+		t.Fatalf("failed to store room: %v", err)
+	}
+
+	room.MarkEncrypted()
+	if !connector.encrypted {
+		t.Fatal("expected the room to be encrypted before the connector is called")
+	}
+
+	stored, err := m.Store.GetRoomByMXID(ctx, room.MXID)
+	if err != nil {
+		t.Fatalf("failed to get room: %v", err)
+	} else if !stored.Encrypted {
+		t.Fatal("expected the room to be saved as encrypted")
+	}
+}
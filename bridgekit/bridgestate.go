@@ -0,0 +1,115 @@
+package bridgekit
+
+import (
+	"context"
+	"time"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+
+	"maunium.net/go/mautrix/bridge/status"
+)
+
+// SendUserBridgeState reports the remote state of the user, for example to show connection problems in Beeper.
+// A state that's identical to the previously reported one is not sent again.
+func (m *BridgeKit[T]) SendUserBridgeState(user *matrix.User, state status.BridgeState) {
+	m.bridgeStatesLock.Lock()
+	prev, ok := m.bridgeStates[user.MXID]
+	if ok && prev.StateEvent == state.StateEvent && prev.Error == state.Error && prev.Message == state.Message {
+		m.bridgeStatesLock.Unlock()
+		return
+	}
+	m.bridgeStates[user.MXID] = state
+	m.bridgeStatesLock.Unlock()
+
+	m.log.Debug().
+		Stringer("user_id", user.MXID).
+		Str("state_event", string(state.StateEvent)).
+		Str("error", string(state.Error)).
+		Msg("Sending user bridge state")
+	user.BridgeState.Send(state)
+}
+
+// GetUserBridgeState returns the last remote state that was reported for the user.
+// The StateEvent is empty if nothing was reported yet.
+func (m *BridgeKit[T]) GetUserBridgeState(user *matrix.User) status.BridgeState {
+	m.bridgeStatesLock.Lock()
+	defer m.bridgeStatesLock.Unlock()
+
+	return m.bridgeStates[user.MXID]
+}
+
+// ReportConnecting reports that the connection of the user to the remote network is being set up.
+func (m *BridgeKit[T]) ReportConnecting(user *matrix.User) {
+	m.SendUserBridgeState(user, status.BridgeState{StateEvent: status.StateConnecting})
+}
+
+// ReportConnected reports that the user is connected to the remote network.
+func (m *BridgeKit[T]) ReportConnected(user *matrix.User) {
+	m.SendUserBridgeState(user, status.BridgeState{StateEvent: status.StateConnected})
+}
+
+// ReportTransientDisconnect reports that the connection of the user was lost, but is expected to come back by itself.
+func (m *BridgeKit[T]) ReportTransientDisconnect(user *matrix.User, code status.BridgeStateErrorCode, message string) {
+	m.SendUserBridgeState(user, status.BridgeState{StateEvent: status.StateTransientDisconnect, Error: code, Message: message})
+}
+
+// ReportBadCredentials reports that the remote network rejected the credentials of the user, so they need to log in again.
+func (m *BridgeKit[T]) ReportBadCredentials(user *matrix.User, code status.BridgeStateErrorCode, message string) {
+	m.SendUserBridgeState(user, status.BridgeState{StateEvent: status.StateBadCredentials, Error: code, Message: message})
+}
+
+// ReportUnknownError reports an error of the user's connection that won't resolve without intervention.
+func (m *BridgeKit[T]) ReportUnknownError(user *matrix.User, code status.BridgeStateErrorCode, message string) {
+	m.SendUserBridgeState(user, status.BridgeState{StateEvent: status.StateUnknownError, Error: code, Message: message})
+}
+
+// RegisterBridgeStateErrors sets the human readable messages for the error codes of the connector.
+// States with a registered error code use this message instead of the one passed when reporting them.
+func (m *BridgeKit[T]) RegisterBridgeStateErrors(errors status.BridgeStateErrorMap) {
+	status.BridgeStateHumanErrors.Update(errors)
+}
+
+// sendGlobalBridgeStateOnce sends the global bridge state without retrying, so that it doesn't block shutdown.
+func (m *BridgeKit[T]) sendGlobalBridgeStateOnce(stateEvent status.BridgeStateEvent) {
+	if m.Bridge.Config.Homeserver.StatusEndpoint == "" && !m.Websocket {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	state := status.BridgeState{StateEvent: stateEvent}.Fill(nil)
+	if err := m.SendBridgeState(ctx, &state); err != nil {
+		m.log.Warn().Err(err).Str("state_event", string(stateEvent)).Msg("Failed to send global bridge state")
+	}
+}
+
+// flushUserBridgeStates sends the last reported state of every loaded user directly, without retrying.
+// The state queues of the users are dropped when the bridge stops, so they may still hold states that weren't sent.
+func (m *BridgeKit[T]) flushUserBridgeStates(ctx context.Context) {
+	if m.Bridge.Config.Homeserver.StatusEndpoint == "" && !m.Websocket {
+		return
+	}
+
+	m.usersLock.Lock()
+	users := make([]*matrix.User, 0, len(m.users))
+	for _, user := range m.users {
+		users = append(users, user)
+	}
+	m.usersLock.Unlock()
+
+	for _, user := range users {
+		state := m.GetUserBridgeState(user)
+		if state.StateEvent == "" {
+			continue
+		}
+
+		state = state.Fill(user)
+		if err := m.SendBridgeState(ctx, &state); err != nil {
+			m.log.Warn().Err(err).Stringer("user_id", user.MXID).Msg("Failed to flush user bridge state")
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
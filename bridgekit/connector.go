@@ -2,6 +2,7 @@ package bridgekit
 
 import (
 	"context"
+	"net/http"
 
 	"github.com/dvcrn/matrix-bridgekit/matrix"
 
@@ -18,6 +19,17 @@ type BridgeConnector interface {
 	// Stop shuts the bridge down
 	Stop()
 
+	// SetManagementRoom sets the management room for the given user.
+	SetManagementRoom(ctx context.Context, user *matrix.User, roomID id.RoomID)
+}
+
+// LegacyConnector has the lookup methods that BridgeConnector required before bridgekit stored rooms, ghosts and
+// users itself. Connectors that still implement them keep working: they're asked for rooms, ghosts and users
+// that aren't in the Store.
+//
+// Deprecated: save rooms, ghosts and users with BridgeKit.SaveRoom, BridgeKit.SaveGhost and BridgeKit.SaveUser,
+// and implement GhostFetcher and UserInitializer instead.
+type LegacyConnector interface {
 	// GetRoom returns the matrix room with the given ID.
 	GetRoom(ctx context.Context, roomID id.RoomID) *matrix.Room
 	// GetAllRooms returns all rooms that the bridge has access to.
@@ -29,11 +41,83 @@ type BridgeConnector interface {
 	GetGhost(ctx context.Context, userID id.UserID) *matrix.Ghost
 	// GetUser returns the user with the given ID. If create is true, it should create a new user if it doesn't exist.
 	GetUser(ctx context.Context, id id.UserID, create bool) *matrix.User
+}
 
-	// SetManagementRoom sets the management room for the given user.
-	SetManagementRoom(ctx context.Context, user *matrix.User, roomID id.RoomID)
+// UserInitializer is an optional interface for connectors that want to fill in remote data for new users.
+type UserInitializer interface {
+	// InitUser is called when bridgekit creates a user that isn't stored yet, before it gets saved.
+	// Use this to set the permission level and remote information of the user.
+	InitUser(ctx context.Context, user *matrix.User) error
+}
+
+// PrivateChatResolver is an optional interface for connectors that support starting direct chats from Matrix.
+type PrivateChatResolver interface {
+	// ResolvePrivateChat finds or creates the remote direct chat between the user and the ghost.
+	// The returned room needs RemotedID, Name and Ghosts set. If it already has an MXID,
+	// the user is pointed to that existing portal instead.
+	ResolvePrivateChat(ctx context.Context, user *matrix.User, ghost *matrix.Ghost) (*matrix.Room, error)
+}
+
+// BridgeInfoCustomizer is an optional interface for connectors that want to customise the bridge info of a room.
+type BridgeInfoCustomizer interface {
+	// CustomizeBridgeInfo is called before the m.bridge state event of the room is sent.
+	// Use this to fill in the channel section, for example with an avatar or external URL.
+	CustomizeBridgeInfo(ctx context.Context, room *matrix.Room, content *event.BridgeEventContent)
 }
 
+// PowerLevelCustomizer is an optional interface for connectors that want different power levels in some rooms.
+type PowerLevelCustomizer interface {
+	// CustomizePowerLevelPolicy is called with a copy of the configured policy before the power levels of the room are generated.
+	CustomizePowerLevelPolicy(ctx context.Context, room *matrix.Room, policy *matrix.PowerLevelPolicy)
+}
+
+// GhostFetcher is an optional interface for connectors that can look up ghosts that aren't stored yet.
+type GhostFetcher interface {
+	// FetchGhost returns the ghost with the given ID from the remote network, or nil if there is no such remote user.
+	FetchGhost(ctx context.Context, userID id.UserID) (*matrix.Ghost, error)
+}
+
+// MediaRequestPreparer is an optional interface for connectors whose remote media needs authentication.
+type MediaRequestPreparer interface {
+	// PrepareMediaRequest is called before remote media like avatars is downloaded.
+	// Use this to add headers or cookies to the request.
+	PrepareMediaRequest(req *http.Request)
+}
+
+// LoginChecker is an optional interface for connectors that know whether users are logged in to the remote network.
+// Without it, users are considered logged in unless their LoginState says otherwise.
+type LoginChecker interface {
+	// IsUserLoggedIn returns whether the user is currently logged in to the remote network.
+	// This is called for every Matrix event and command, so it shouldn't do any network requests.
+	IsUserLoggedIn(ctx context.Context, user *matrix.User) bool
+}
+
+// LoginHandler is an optional interface for connectors that let users log in with bridge commands.
+// If implemented, bridgekit provides the login, logout and cancel commands.
+type LoginHandler interface {
+	// GetLoginFlows returns the supported login flows. The first one is used if the user doesn't pick one.
+	GetLoginFlows() []LoginFlow
+	// CreateLogin creates a new login process for the user with the given flow.
+	CreateLogin(ctx context.Context, user *matrix.User, flowID string) (LoginProcess, error)
+	// Logout logs the user out of the remote network. The stored credentials are cleared afterwards.
+	Logout(ctx context.Context, user *matrix.User) error
+}
+
+// UserConnector is an optional interface for connectors that keep a remote session per user.
+// bridgekit connects all logged in users on start and after a login, reconnects them with backoff
+// when the session fails, and reports the matching bridge states.
+type UserConnector interface {
+	// Connect connects the user to the remote network and blocks until the session ends.
+	// Call connected once the session is established, which resets the backoff.
+	// Return an error wrapping ErrBadCredentials if the user needs to log in again, and nil if the session
+	// ended on purpose and shouldn't be reconnected. Any other error is retried.
+	Connect(ctx context.Context, user *matrix.User, connected func()) error
+	// Disconnect ends the session of the user. The context passed to Connect is cancelled as well.
+	Disconnect(user *matrix.User)
+}
+
+// MatrixRoomEventHandler is the generic handler for matrix room events.
+// Events that aren't handled by one of the typed handlers below are passed to HandleMatrixRoomEvent.
 type MatrixRoomEventHandler interface {
 	// HandleMatrixRoomEvent is the callback to handle matrix events within a specific room.
 	HandleMatrixRoomEvent(ctx context.Context, room *matrix.Room, user bridge.User, evt *event.Event) error
@@ -41,3 +125,57 @@ type MatrixRoomEventHandler interface {
 	// HandleMatrixRoomMemberEvent is called when a specific room is marked as encrypted
 	HandleMatrixMarkEncrypted(ctx context.Context, room *matrix.Room) error
 }
+
+// MatrixMessageHandler is an optional interface to handle new messages and stickers sent in a room.
+type MatrixMessageHandler interface {
+	HandleMatrixMessage(ctx context.Context, room *matrix.Room, user bridge.User, evt *event.Event, content *event.MessageEventContent) error
+}
+
+// MatrixEditHandler is an optional interface to handle message edits.
+// original is the bridged message that got edited, or nil if the edited event isn't known to bridgekit.
+type MatrixEditHandler interface {
+	HandleMatrixEdit(ctx context.Context, room *matrix.Room, user bridge.User, evt *event.Event, newContent *event.MessageEventContent, original *matrix.BridgedMessage) error
+}
+
+// MatrixReactionHandler is an optional interface to handle reactions.
+type MatrixReactionHandler interface {
+	HandleMatrixReaction(ctx context.Context, room *matrix.Room, user bridge.User, evt *event.Event, content *event.ReactionEventContent) error
+}
+
+// MatrixRedactionHandler is an optional interface to handle redactions.
+// original is the bridged message that got redacted, or nil if the redacted event isn't a known message.
+// If the handler returns no error, the mapping of the redacted message is removed.
+type MatrixRedactionHandler interface {
+	HandleMatrixRedaction(ctx context.Context, room *matrix.Room, user bridge.User, evt *event.Event, original *matrix.BridgedMessage) error
+}
+
+// MatrixReadReceiptHandler is an optional interface to handle read receipts.
+type MatrixReadReceiptHandler interface {
+	HandleMatrixReadReceipt(ctx context.Context, room *matrix.Room, user bridge.User, eventID id.EventID, receipt event.ReadReceipt) error
+}
+
+// MatrixTypingHandler is an optional interface to handle typing notifications.
+// userIDs contains everyone who is currently typing in the room.
+type MatrixTypingHandler interface {
+	HandleMatrixTyping(ctx context.Context, room *matrix.Room, userIDs []id.UserID) error
+}
+
+// MatrixMembershipHandler is an optional interface to handle leaves, kicks and invites.
+type MatrixMembershipHandler interface {
+	HandleMatrixMembership(ctx context.Context, room *matrix.Room, user bridge.User, evt *event.Event, content *event.MemberEventContent) error
+}
+
+// MatrixRoomNameHandler is an optional interface to handle room name changes.
+type MatrixRoomNameHandler interface {
+	HandleMatrixRoomName(ctx context.Context, room *matrix.Room, user bridge.User, evt *event.Event, content *event.RoomNameEventContent) error
+}
+
+// MatrixRoomTopicHandler is an optional interface to handle room topic changes.
+type MatrixRoomTopicHandler interface {
+	HandleMatrixRoomTopic(ctx context.Context, room *matrix.Room, user bridge.User, evt *event.Event, content *event.TopicEventContent) error
+}
+
+// MatrixRoomAvatarHandler is an optional interface to handle room avatar changes.
+type MatrixRoomAvatarHandler interface {
+	HandleMatrixRoomAvatar(ctx context.Context, room *matrix.Room, user bridge.User, evt *event.Event, content *event.RoomAvatarEventContent) error
+}
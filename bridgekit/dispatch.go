@@ -0,0 +1,143 @@
+package bridgekit
+
+import (
+	"context"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// TrackMatrixEvent implements matrix.RoomEventHandler. Queued events count as in-flight work, so they're drained on shutdown.
+func (m *BridgeKit[T]) TrackMatrixEvent(room *matrix.Room) (func(), bool) {
+	done, ok := m.inFlight.start(workMatrixEvent)
+	if !ok {
+		m.log.Warn().Stringer("room_id", room.MXID).Msg("Dropping Matrix event as the bridge is shutting down")
+	}
+
+	return done, ok
+}
+
+func (m *BridgeKit[T]) HandleMatrixReadReceipt(room *matrix.Room, user bridge.User, eventID id.EventID, receipt event.ReadReceipt) {
+	if handler, ok := m.Connector.(MatrixReadReceiptHandler); ok {
+		if err := handler.HandleMatrixReadReceipt(m.parentCtx, room, user, eventID, receipt); err != nil {
+			m.log.Err(err).Stringer("room_id", room.MXID).Stringer("event_id", eventID).Msg("Failed to handle read receipt")
+		}
+	}
+}
+
+func (m *BridgeKit[T]) HandleMatrixTyping(room *matrix.Room, userIDs []id.UserID) {
+	if handler, ok := m.Connector.(MatrixTypingHandler); ok {
+		done, ok := m.inFlight.start(workMatrixEvent)
+		if !ok {
+			return
+		}
+		defer done()
+
+		if err := handler.HandleMatrixTyping(withInFlight(m.parentCtx), room, userIDs); err != nil {
+			m.log.Err(err).Stringer("room_id", room.MXID).Msg("Failed to handle typing notification")
+		}
+	}
+}
+
+func (m *BridgeKit[T]) handleMatrixRoomEvent(room *matrix.Room, user bridge.User, evt *event.Event) {
+	log := m.log.With().
+		Stringer("room_id", room.MXID).
+		Stringer("event_id", evt.ID).
+		Stringer("sender", evt.Sender).
+		Str("event_type", evt.Type.Type).
+		Logger()
+	ctx := withInFlight(log.WithContext(m.parentCtx))
+
+	if evt.Type == event.EventRedaction {
+		m.forgetRedactedReaction(ctx, redactedEventID(evt))
+	}
+
+	if handled, err := m.dispatchTypedMatrixEvent(ctx, room, user, evt); handled {
+		if err != nil {
+			log.Err(err).Msg("Failed to handle Matrix event")
+		}
+
+		return
+	}
+
+	// check if connector implements RoomEventHandler with type assertion
+	if roomEventHandler, ok := m.Connector.(MatrixRoomEventHandler); ok {
+		err := roomEventHandler.HandleMatrixRoomEvent(ctx, room, user, evt)
+		if err != nil {
+			log.Err(err).Msg("Failed to handle Matrix event")
+		}
+
+		return
+	}
+
+	log.Debug().Msg("Connector has no handler for Matrix event")
+}
+
+// dispatchTypedMatrixEvent calls the typed handler for the event if the connector implements it.
+// Returns false if there is no typed handler, so the event should go to the generic handler instead.
+func (m *BridgeKit[T]) dispatchTypedMatrixEvent(ctx context.Context, room *matrix.Room, user bridge.User, evt *event.Event) (bool, error) {
+	switch evt.Type {
+	case event.EventMessage, event.EventSticker:
+		content := evt.Content.AsMessage()
+		if editID := content.RelatesTo.GetReplaceID(); editID != "" && content.NewContent != nil {
+			handler, ok := m.Connector.(MatrixEditHandler)
+			if !ok {
+				return false, nil
+			}
+
+			return true, handler.HandleMatrixEdit(ctx, room, user, evt, content.NewContent, m.GetMessageByEventID(ctx, editID))
+		}
+
+		if handler, ok := m.Connector.(MatrixMessageHandler); ok {
+			return true, handler.HandleMatrixMessage(ctx, room, user, evt, content)
+		}
+	case event.EventReaction:
+		if handler, ok := m.Connector.(MatrixReactionHandler); ok {
+			return true, handler.HandleMatrixReaction(ctx, room, user, evt, evt.Content.AsReaction())
+		}
+	case event.EventRedaction:
+		if handler, ok := m.Connector.(MatrixRedactionHandler); ok {
+			original := m.GetMessageByEventID(ctx, redactedEventID(evt))
+			err := handler.HandleMatrixRedaction(ctx, room, user, evt, original)
+			if err == nil && original != nil {
+				// the message is gone on both sides now, so the mapping is no longer needed
+				if err := m.Store.DeleteMessage(ctx, original); err != nil {
+					zerolog.Ctx(ctx).Err(err).Msg("Failed to delete mapping of redacted message")
+				}
+			}
+
+			return true, err
+		}
+	case event.StateMember:
+		if handler, ok := m.Connector.(MatrixMembershipHandler); ok {
+			return true, handler.HandleMatrixMembership(ctx, room, user, evt, evt.Content.AsMember())
+		}
+	case event.StateRoomName:
+		if handler, ok := m.Connector.(MatrixRoomNameHandler); ok {
+			return true, handler.HandleMatrixRoomName(ctx, room, user, evt, evt.Content.AsRoomName())
+		}
+	case event.StateTopic:
+		if handler, ok := m.Connector.(MatrixRoomTopicHandler); ok {
+			return true, handler.HandleMatrixRoomTopic(ctx, room, user, evt, evt.Content.AsTopic())
+		}
+	case event.StateRoomAvatar:
+		if handler, ok := m.Connector.(MatrixRoomAvatarHandler); ok {
+			return true, handler.HandleMatrixRoomAvatar(ctx, room, user, evt, evt.Content.AsRoomAvatar())
+		}
+	}
+
+	return false, nil
+}
+
+// redactedEventID returns the ID of the event that the redaction event redacts.
+func redactedEventID(evt *event.Event) id.EventID {
+	if evt.Redacts != "" {
+		return evt.Redacts
+	}
+
+	return evt.Content.AsRedaction().Redacts
+}
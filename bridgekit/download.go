@@ -0,0 +1,101 @@
+package bridgekit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dvcrn/matrix-bridgekit/media"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ErrMediaTooLarge is returned when a Matrix file is larger than the maximum download size.
+var ErrMediaTooLarge = errors.New("media is too large")
+
+// DownloadedMedia is a file that was downloaded from Matrix and decrypted if necessary.
+type DownloadedMedia struct {
+	// Reader returns the plaintext bytes of the file.
+	Reader   io.Reader
+	Size     int
+	MimeType string
+	FileName string
+}
+
+// DownloadMatrixMedia downloads the file of an incoming media message, decrypting it if it was sent in an encrypted room.
+// Files larger than MaxDownloadSize are rejected with ErrMediaTooLarge.
+func (m *BridgeKit[T]) DownloadMatrixMedia(ctx context.Context, content *event.MessageEventContent) (*DownloadedMedia, error) {
+	maxSize := m.maxDownloadSize()
+	if content.Info != nil && int64(content.Info.Size) > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMediaTooLarge, content.Info.Size)
+	}
+
+	rawURL := content.URL
+	if content.File != nil {
+		rawURL = content.File.URL
+	}
+	mxc, err := rawURL.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse content URI: %w", err)
+	}
+
+	data, err := m.downloadLimited(ctx, mxc, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if content.File != nil {
+		if err := content.File.DecryptInPlace(data); err != nil {
+			return nil, fmt.Errorf("failed to decrypt media: %w", err)
+		}
+	}
+
+	fileName := content.GetFileName()
+	mimeType := ""
+	if content.Info != nil {
+		mimeType = content.Info.MimeType
+	}
+	if mimeType == "" {
+		mimeType = media.DetectMimeType(data, fileName)
+	}
+
+	return &DownloadedMedia{
+		Reader:   bytes.NewReader(data),
+		Size:     len(data),
+		MimeType: mimeType,
+		FileName: fileName,
+	}, nil
+}
+
+func (m *BridgeKit[T]) downloadLimited(ctx context.Context, mxc id.ContentURI, maxSize int64) ([]byte, error) {
+	resp, err := m.Bot.Download(ctx, mxc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download media: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMediaTooLarge, resp.ContentLength)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read media: %w", err)
+	} else if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrMediaTooLarge, maxSize)
+	}
+
+	return data, nil
+}
+
+// maxDownloadSize returns MaxDownloadSize, or the upload limit of the homeserver if it isn't set.
+func (m *BridgeKit[T]) maxDownloadSize() int64 {
+	if m.MaxDownloadSize > 0 {
+		return m.MaxDownloadSize
+	}
+
+	return m.MediaConfig.UploadSize
+}
@@ -0,0 +1,88 @@
+package bridgekit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ErrUnknownMessage is returned when a remote message ID has no mapped Matrix event.
+var ErrUnknownMessage = errors.New("unknown remote message")
+
+// SendEditInRoom sends an edit of the original event in the given room, using the provided sender intent.
+// The sender has to be the same as the sender of the original event, otherwise clients will ignore the edit.
+func (m *BridgeKit[T]) SendEditInRoom(ctx context.Context, room *matrix.Room, sender *appservice.IntentAPI, original id.EventID, content *event.MessageEventContent) (*mautrix.RespSendEvent, error) {
+	return m.SendTimestampedEditInRoom(ctx, room, sender, original, content, 0)
+}
+
+// SendTimestampedEditInRoom sends an edit of the original event with the given timestamp, using the provided sender intent.
+// content is the new content of the message, the "* " fallback body and relation are added automatically.
+func (m *BridgeKit[T]) SendTimestampedEditInRoom(ctx context.Context, room *matrix.Room, sender *appservice.IntentAPI, original id.EventID, content *event.MessageEventContent, ts int64) (*mautrix.RespSendEvent, error) {
+	defer m.trackWork(workSend)()
+
+	if sender == nil {
+		return nil, errors.New("no sender intent passed")
+	}
+
+	editContent := *content
+	editContent.SetEdit(original)
+
+	var resp *mautrix.RespSendEvent
+	var err error
+	if ts > 0 {
+		resp, err = sender.SendMassagedMessageEvent(ctx, room.MXID, event.EventMessage, &editContent, ts)
+	} else {
+		resp, err = sender.SendMessageEvent(ctx, room.MXID, event.EventMessage, &editContent)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// SendBotEditInRoom sends an edit of a message that was sent by the bot.
+func (m *BridgeKit[T]) SendBotEditInRoom(ctx context.Context, room *matrix.Room, original id.EventID, content *event.MessageEventContent) (*mautrix.RespSendEvent, error) {
+	return m.SendEditInRoom(ctx, room, m.Bot, original, content)
+}
+
+// SendUserEditInRoom sends an edit of a message that was sent by the given user, either through double puppeting or the user's ghost.
+func (m *BridgeKit[T]) SendUserEditInRoom(ctx context.Context, room *matrix.Room, user *matrix.User, original id.EventID, content *event.MessageEventContent) (*mautrix.RespSendEvent, error) {
+	return m.SendEditInRoom(ctx, room, m.GhostMaster.AsUserGhost(ctx, user), original, content)
+}
+
+// SendRemoteEditInRoom edits the Matrix event that the given part of a remote message was bridged as.
+// The edit is sent as the original sender of the message, so ghost, bot and double puppet messages all work.
+func (m *BridgeKit[T]) SendRemoteEditInRoom(ctx context.Context, room *matrix.Room, remoteID string, partIndex int, content *event.MessageEventContent, ts int64) (*mautrix.RespSendEvent, error) {
+	original := m.GetMessageByRemoteID(ctx, room, remoteID, partIndex)
+	if original == nil {
+		return nil, fmt.Errorf("%w %s", ErrUnknownMessage, remoteID)
+	}
+
+	return m.SendTimestampedEditInRoom(ctx, room, m.intentForSender(ctx, original.SenderMXID), original.EventID, content, ts)
+}
+
+// intentForSender returns the intent to act as the given Matrix user: the bot, a ghost,
+// or the double puppet/ghost of a bridge user. Falls back to the bot if the user is unknown.
+func (m *BridgeKit[T]) intentForSender(ctx context.Context, userID id.UserID) *appservice.IntentAPI {
+	if userID == "" || userID == m.Bot.UserID {
+		return m.Bot
+	}
+
+	if m.GhostMaster.IsGhostMXID(userID) {
+		return m.Bridge.AS.Intent(userID)
+	}
+
+	if user := m.GetUser(ctx, userID, false); user != nil {
+		return m.GhostMaster.AsUserGhost(ctx, user)
+	}
+
+	return m.Bot
+}
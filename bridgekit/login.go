@@ -0,0 +1,68 @@
+package bridgekit
+
+import (
+	"context"
+)
+
+// LoginFlow is one way of logging in to the remote network, such as with a password, a cookie or a QR code.
+type LoginFlow struct {
+	// ID is passed to LoginHandler.CreateLogin and is what the user types after the login command.
+	ID          string
+	Name        string
+	Description string
+}
+
+// LoginStepType is the kind of a LoginStep.
+type LoginStepType string
+
+const (
+	// LoginStepTypeUserInput asks the user for the values of the fields of the step.
+	LoginStepTypeUserInput LoginStepType = "user_input"
+	// LoginStepTypeDisplayAndWait shows a QR code or a code to the user, then waits for LoginProcess.Wait.
+	LoginStepTypeDisplayAndWait LoginStepType = "display_and_wait"
+	// LoginStepTypeComplete finishes the login and stores the remote credentials on the user.
+	LoginStepTypeComplete LoginStepType = "complete"
+)
+
+// LoginInputField is a value the user is asked for in a user input step.
+type LoginInputField struct {
+	ID          string
+	Name        string
+	Description string
+	// Secret fields, like passwords and cookies, are redacted from the room after the user sent them.
+	Secret bool
+}
+
+// LoginStep is a single step of a login process.
+type LoginStep struct {
+	Type LoginStepType
+	// Instructions are shown to the user at the start of the step.
+	Instructions string
+
+	// Fields are asked for one after the other in a user input step.
+	Fields []LoginInputField
+
+	// QRCode is rendered as an image in a display step.
+	QRCode string
+	// Code is shown as text in a display step, for example a pairing code.
+	Code string
+
+	// RemoteID, RemoteName and Credentials are stored on the user in a complete step.
+	RemoteID    string
+	RemoteName  string
+	Credentials map[string]string
+}
+
+// LoginProcess is an ongoing login of a user, created by LoginHandler.CreateLogin.
+// Multi-step logins return further user input or display steps until the login is complete.
+type LoginProcess interface {
+	// Start returns the first step of the login.
+	Start(ctx context.Context) (*LoginStep, error)
+	// SubmitInput is called with the values of the fields of a user input step, keyed by field ID.
+	SubmitInput(ctx context.Context, input map[string]string) (*LoginStep, error)
+	// Wait is called after a display step and blocks until the next step, for example until the QR code was scanned.
+	// Returning another display step replaces the shown QR code.
+	Wait(ctx context.Context) (*LoginStep, error)
+	// Cancel is called when the user cancels the login. The context of the login is cancelled as well.
+	Cancel()
+}
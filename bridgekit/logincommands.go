@@ -0,0 +1,357 @@
+package bridgekit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+	"github.com/skip2/go-qrcode"
+
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// qrCodeSize is the width and height of rendered login QR codes.
+const qrCodeSize = 256
+
+// loginSession is an ongoing login of a user. The Wait goroutine and the login, input and cancel commands
+// run concurrently, so lock guards ended and the state of the current step.
+type loginSession struct {
+	process LoginProcess
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	lock       sync.Mutex
+	ended      bool
+	step       *LoginStep
+	input      map[string]string
+	fieldIndex int
+
+	displayEventID id.EventID
+}
+
+func (m *BridgeKit[T]) loginCommands() []commands.Handler {
+	return []commands.Handler{
+		&commands.FullHandler{
+			Func: m.fnLogin,
+			Name: "login",
+			Help: commands.HelpMeta{
+				Section:     commands.HelpSectionAuth,
+				Description: "Log in to the remote network.",
+				Args:        "[_flow_]",
+			},
+		},
+		&commands.FullHandler{
+			Func: m.fnLogout,
+			Name: "logout",
+			Help: commands.HelpMeta{
+				Section:     commands.HelpSectionAuth,
+				Description: "Log out of the remote network.",
+			},
+			RequiresLogin: true,
+		},
+		&commands.FullHandler{
+			Func: m.fnCancel,
+			Name: "cancel",
+			Help: commands.HelpMeta{
+				Section:     commands.HelpSectionGeneral,
+				Description: "Cancel an ongoing action.",
+			},
+		},
+	}
+}
+
+func (m *BridgeKit[T]) fnLogin(ce *commands.Event) {
+	handler := m.Connector.(LoginHandler)
+	user := ce.User.(*matrix.User)
+
+	if user.GetCommandState() != nil {
+		ce.Reply("You already have an ongoing action, use `$cmdprefix cancel` to cancel it.")
+		return
+	} else if m.hasRemoteLogin(ce.Ctx, user) {
+		ce.Reply("You're already logged in.")
+		return
+	}
+
+	flows := handler.GetLoginFlows()
+	if len(flows) == 0 {
+		ce.Reply("This bridge doesn't support logging in.")
+		return
+	}
+
+	flow := flows[0]
+	if len(ce.Args) > 0 {
+		found := false
+		for _, f := range flows {
+			if strings.EqualFold(f.ID, ce.Args[0]) {
+				flow, found = f, true
+				break
+			}
+		}
+
+		if !found {
+			ce.Reply("Unknown login flow. Available flows:\n\n%s", formatLoginFlows(flows))
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ce.ZLog.WithContext(m.parentCtx))
+	process, err := handler.CreateLogin(ctx, user, flow.ID)
+	if err != nil {
+		cancel()
+		ce.ZLog.Err(err).Str("flow_id", flow.ID).Msg("Failed to create login")
+		ce.Reply("Failed to start login: %v", err)
+		return
+	}
+
+	session := &loginSession{process: process, ctx: ctx, cancel: cancel}
+	user.SetCommandState(&commands.CommandState{Action: "Login", Meta: session})
+
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	step, err := process.Start(ctx)
+	m.handleLoginStep(ce, user, session, step, err)
+}
+
+// handleLoginStep must be called with the lock of the session held.
+func (m *BridgeKit[T]) handleLoginStep(ce *commands.Event, user *matrix.User, session *loginSession, step *LoginStep, err error) {
+	if session.ended || session.ctx.Err() != nil {
+		// the login was cancelled in the meantime
+		return
+	} else if err != nil {
+		ce.ZLog.Err(err).Msg("Login failed")
+		ce.Reply("Login failed: %v", err)
+		m.endLogin(user, session)
+		return
+	} else if step == nil {
+		ce.Reply("Login failed: no next step")
+		m.endLogin(user, session)
+		return
+	}
+
+	if step.Instructions != "" {
+		ce.Reply("%s", step.Instructions)
+	}
+
+	switch step.Type {
+	case LoginStepTypeUserInput:
+		if len(step.Fields) == 0 {
+			ce.Reply("Login failed: no fields to fill in")
+			m.endLogin(user, session)
+			return
+		}
+
+		session.step = step
+		session.input = make(map[string]string, len(step.Fields))
+		session.fieldIndex = 0
+		user.SetCommandState(&commands.CommandState{
+			Action: "Login",
+			Next: commands.MinimalHandlerFunc(func(ce *commands.Event) {
+				m.fnLoginInput(ce, user, session)
+			}),
+			Meta: session,
+		})
+		promptLoginField(ce, step.Fields[0])
+	case LoginStepTypeDisplayAndWait:
+		user.SetCommandState(&commands.CommandState{Action: "Login", Meta: session})
+		if err := m.displayLoginStep(ce, session, step); err != nil {
+			ce.ZLog.Err(err).Msg("Failed to display login step")
+			ce.Reply("Login failed: %v", err)
+			session.process.Cancel()
+			m.endLogin(user, session)
+			return
+		}
+
+		// the command event is done once the command returns, so don't reply with its context
+		waitCE := *ce
+		waitCE.Ctx = ce.ZLog.WithContext(m.parentCtx)
+		go func() {
+			next, err := session.process.Wait(session.ctx)
+			session.lock.Lock()
+			defer session.lock.Unlock()
+			m.handleLoginStep(&waitCE, user, session, next, err)
+		}()
+	case LoginStepTypeComplete:
+		m.completeLogin(ce, user, session, step)
+	default:
+		ce.Reply("Login failed: unknown step type %s", step.Type)
+		m.endLogin(user, session)
+	}
+}
+
+func (m *BridgeKit[T]) fnLoginInput(ce *commands.Event, user *matrix.User, session *loginSession) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.ended {
+		return
+	}
+
+	field := session.step.Fields[session.fieldIndex]
+	if field.Secret {
+		ce.Redact()
+	}
+
+	session.input[field.ID] = strings.TrimSpace(ce.RawArgs)
+	session.fieldIndex++
+	if session.fieldIndex < len(session.step.Fields) {
+		promptLoginField(ce, session.step.Fields[session.fieldIndex])
+		return
+	}
+
+	step, err := session.process.SubmitInput(session.ctx, session.input)
+	m.handleLoginStep(ce, user, session, step, err)
+}
+
+// displayLoginStep sends the QR code and code of the step. A refreshed QR code replaces the previous one with an edit.
+func (m *BridgeKit[T]) displayLoginStep(ce *commands.Event, session *loginSession, step *LoginStep) error {
+	if step.Code != "" {
+		ce.Reply("Your code: `%s`", step.Code)
+	}
+	if step.QRCode == "" {
+		return nil
+	}
+
+	qr, err := qrcode.Encode(step.QRCode, qrcode.Low, qrCodeSize)
+	if err != nil {
+		return fmt.Errorf("failed to render QR code: %w", err)
+	}
+
+	resp, err := ce.Bot.UploadBytes(ce.Ctx, qr, "image/png")
+	if err != nil {
+		return fmt.Errorf("failed to upload QR code: %w", err)
+	}
+
+	content := &event.MessageEventContent{
+		MsgType: event.MsgImage,
+		Body:    step.QRCode,
+		URL:     resp.ContentURI.CUString(),
+		Info: &event.FileInfo{
+			MimeType: "image/png",
+			Width:    qrCodeSize,
+			Height:   qrCodeSize,
+			Size:     len(qr),
+		},
+	}
+	if session.displayEventID != "" {
+		content.SetEdit(session.displayEventID)
+	}
+
+	sendResp, err := ce.Bot.SendMessageEvent(ce.Ctx, ce.RoomID, event.EventMessage, content)
+	if err != nil {
+		return fmt.Errorf("failed to send QR code: %w", err)
+	}
+	if session.displayEventID == "" {
+		session.displayEventID = sendResp.EventID
+	}
+
+	return nil
+}
+
+func (m *BridgeKit[T]) completeLogin(ce *commands.Event, user *matrix.User, session *loginSession, step *LoginStep) {
+	m.endLogin(user, session)
+
+	if step.RemoteID != "" {
+		user.RemoteID = step.RemoteID
+	}
+	if step.RemoteName != "" {
+		user.RemoteName = step.RemoteName
+	}
+	user.Credentials = step.Credentials
+
+	if err := m.SetUserLoginState(ce.Ctx, user, matrix.LoginStateLoggedIn, ""); err != nil {
+		ce.ZLog.Err(err).Msg("Failed to save login")
+		ce.Reply("Logged in, but failed to save the login: %v", err)
+		return
+	}
+
+	name := user.RemoteName
+	if name == "" {
+		name = user.RemoteID
+	}
+	ce.Reply("Successfully logged in as %s", name)
+	m.ConnectUser(user)
+}
+
+// endLogin marks the login as ended, cancels its context and clears the command state if it still belongs to the login.
+// It must be called with the lock of the session held.
+func (m *BridgeKit[T]) endLogin(user *matrix.User, session *loginSession) {
+	session.ended = true
+	session.cancel()
+	if state := user.GetCommandState(); state != nil && state.Meta == session {
+		user.SetCommandState(nil)
+	}
+}
+
+func (m *BridgeKit[T]) fnLogout(ce *commands.Event) {
+	handler := m.Connector.(LoginHandler)
+	user := ce.User.(*matrix.User)
+
+	m.DisconnectUser(user)
+	if err := handler.Logout(ce.Ctx, user); err != nil {
+		ce.ZLog.Err(err).Msg("Failed to log out")
+		ce.Reply("Failed to log out: %v", err)
+		return
+	}
+
+	user.Credentials = nil
+	if err := m.SetUserLoginState(ce.Ctx, user, matrix.LoginStateLoggedOut, ""); err != nil {
+		ce.ZLog.Err(err).Msg("Failed to save logout")
+	}
+	ce.Reply("Logged out.")
+}
+
+// fnCancel replaces the default cancel command, so that ongoing logins are cancelled on the connector side too.
+func (m *BridgeKit[T]) fnCancel(ce *commands.Event) {
+	user := ce.User.(*matrix.User)
+	state := user.GetCommandState()
+	if state == nil {
+		ce.Reply("No ongoing command.")
+		return
+	}
+
+	if session, ok := state.Meta.(*loginSession); ok {
+		// cancel the context first, so that a running step returns and releases the lock
+		session.cancel()
+		session.lock.Lock()
+		ended := session.ended
+		m.endLogin(user, session)
+		session.lock.Unlock()
+
+		if ended {
+			// the login completed or failed while waiting for the lock
+			ce.Reply("No ongoing command.")
+			return
+		}
+		session.process.Cancel()
+	}
+	user.SetCommandState(nil)
+
+	action := state.Action
+	if action == "" {
+		action = "Unknown action"
+	}
+	ce.Reply("%s cancelled.", action)
+}
+
+func promptLoginField(ce *commands.Event, field LoginInputField) {
+	msg := fmt.Sprintf("Please enter your %s.", field.Name)
+	if field.Description != "" {
+		msg += " " + field.Description
+	}
+	ce.Reply("%s", msg)
+}
+
+func formatLoginFlows(flows []LoginFlow) string {
+	lines := make([]string, len(flows))
+	for i, flow := range flows {
+		lines[i] = fmt.Sprintf("* `%s` - %s", flow.ID, flow.Name)
+		if flow.Description != "" {
+			lines[i] += ": " + flow.Description
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,53 @@
+package bridgekit
+
+import (
+	"context"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge/status"
+)
+
+// SetUserLoginState updates and persists the login state of the user, and reports it as bridge state.
+// Logging out or losing the credentials is reported as LOGGED_OUT or BAD_CREDENTIALS, logging in as CONNECTED.
+// The message is shown to the user by clients that display bridge state.
+func (m *BridgeKit[T]) SetUserLoginState(ctx context.Context, user *matrix.User, state matrix.LoginState, message string) error {
+	return m.setUserLoginState(ctx, user, state, "", message)
+}
+
+// setUserLoginState is SetUserLoginState with an error code for the reported bridge state.
+func (m *BridgeKit[T]) setUserLoginState(ctx context.Context, user *matrix.User, state matrix.LoginState, code status.BridgeStateErrorCode, message string) error {
+	zerolog.Ctx(ctx).Debug().
+		Stringer("user_id", user.MXID).
+		Str("login_state", string(state)).
+		Msg("Updating login state")
+
+	user.LoginState = state
+	if err := m.Store.PutUser(ctx, user); err != nil {
+		return err
+	}
+
+	if stateEvent, ok := loginBridgeStates[state]; ok {
+		m.SendUserBridgeState(user, status.BridgeState{StateEvent: stateEvent, Error: code, Message: message})
+	}
+
+	return nil
+}
+
+var loginBridgeStates = map[matrix.LoginState]status.BridgeStateEvent{
+	matrix.LoginStateLoggedIn:       status.StateConnected,
+	matrix.LoginStateLoggedOut:      status.StateLoggedOut,
+	matrix.LoginStateBadCredentials: status.StateBadCredentials,
+}
+
+// hasRemoteLogin returns whether the user is logged in to the remote network, as decided by the connector if it
+// implements LoginChecker, and by the LoginState of the user otherwise. Unlike User.IsLoggedIn, users whose login
+// state was never set don't count, as every Matrix user who talks to the bridge gets stored.
+func (m *BridgeKit[T]) hasRemoteLogin(ctx context.Context, user *matrix.User) bool {
+	if checker, ok := m.Connector.(LoginChecker); ok {
+		return checker.IsUserLoggedIn(ctx, user)
+	}
+
+	return user.LoginState == matrix.LoginStateLoggedIn
+}
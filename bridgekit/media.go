@@ -0,0 +1,144 @@
+package bridgekit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+	"github.com/dvcrn/matrix-bridgekit/media"
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// thumbnailSize is the maximum width and height of generated image thumbnails.
+const thumbnailSize = 800
+
+// SendMediaMessage uploads the given file and sends it as a media message into the room, using the provided sender intent.
+func (m *BridgeKit[T]) SendMediaMessage(ctx context.Context, room *matrix.Room, sender *appservice.IntentAPI, data []byte, fileName string) (*mautrix.RespSendEvent, error) {
+	defer m.trackWork(workMedia)()
+
+	content, err := m.PrepareMediaMessage(ctx, room, data, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.SendMessageInRoom(ctx, room, sender, content)
+}
+
+// SendMediaMessageFromReader reads the file from the given reader and sends it as a media message into the room.
+func (m *BridgeKit[T]) SendMediaMessageFromReader(ctx context.Context, room *matrix.Room, sender *appservice.IntentAPI, reader io.Reader, fileName string) (*mautrix.RespSendEvent, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read media: %w", err)
+	}
+
+	return m.SendMediaMessage(ctx, room, sender, data, fileName)
+}
+
+// PrepareMediaMessage uploads the given file and returns the message content for it without sending it.
+// The MIME type is detected from the data, and the info block is filled with the size, dimensions and duration.
+// Images get a thumbnail if they're larger than the thumbnail size.
+// In encrypted rooms, the file is encrypted before uploading and referenced in the file field instead of url.
+func (m *BridgeKit[T]) PrepareMediaMessage(ctx context.Context, room *matrix.Room, data []byte, fileName string) (*event.MessageEventContent, error) {
+	mimeType := media.DetectMimeType(data, fileName)
+	content := &event.MessageEventContent{
+		MsgType:  media.MessageType(mimeType),
+		Body:     fileName,
+		FileName: fileName,
+		Info: &event.FileInfo{
+			MimeType: mimeType,
+			Size:     len(data),
+		},
+	}
+
+	switch content.MsgType {
+	case event.MsgImage:
+		width, height, err := media.ImageSize(data)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("file_name", fileName).Msg("Failed to read image size")
+			break
+		}
+		content.Info.Width, content.Info.Height = width, height
+
+		if width > thumbnailSize || height > thumbnailSize {
+			if err := m.addThumbnail(ctx, room, content, data); err != nil {
+				zerolog.Ctx(ctx).Warn().Err(err).Str("file_name", fileName).Msg("Failed to create thumbnail")
+			}
+		}
+	case event.MsgVideo, event.MsgAudio:
+		duration, width, height, err := media.Probe(ctx, data, fileName)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("file_name", fileName).Msg("Failed to probe media")
+			break
+		}
+		content.Info.Duration, content.Info.Width, content.Info.Height = duration, width, height
+	}
+
+	url, file, err := m.uploadMedia(ctx, room, data, mimeType, fileName)
+	if err != nil {
+		return nil, err
+	}
+	content.URL, content.File = url, file
+
+	return content, nil
+}
+
+func (m *BridgeKit[T]) addThumbnail(ctx context.Context, room *matrix.Room, content *event.MessageEventContent, data []byte) error {
+	thumbnail, width, height, err := media.Thumbnail(data, thumbnailSize)
+	if err != nil {
+		return err
+	}
+
+	url, file, err := m.uploadMedia(ctx, room, thumbnail, "image/jpeg", "thumbnail.jpg")
+	if err != nil {
+		return err
+	}
+
+	content.Info.ThumbnailURL, content.Info.ThumbnailFile = url, file
+	content.Info.ThumbnailInfo = &event.FileInfo{
+		MimeType: "image/jpeg",
+		Width:    width,
+		Height:   height,
+		Size:     len(thumbnail),
+	}
+
+	return nil
+}
+
+// uploadMedia uploads the data to the media repo. In encrypted rooms, the data is encrypted
+// first and the returned file info has to be used instead of the URL.
+func (m *BridgeKit[T]) uploadMedia(ctx context.Context, room *matrix.Room, data []byte, mimeType, fileName string) (id.ContentURIString, *event.EncryptedFileInfo, error) {
+	var file *event.EncryptedFileInfo
+	uploadMime := mimeType
+	if room.Encrypted {
+		file = &event.EncryptedFileInfo{
+			EncryptedFile: *attachment.NewEncryptedFile(),
+		}
+		data = file.Encrypt(data)
+		uploadMime = "application/octet-stream"
+		fileName = ""
+	}
+
+	resp, err := m.Bot.UploadMedia(ctx, mautrix.ReqUploadMedia{
+		ContentBytes: data,
+		ContentType:  strings.SplitN(uploadMime, ";", 2)[0],
+		FileName:     fileName,
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to upload media: %w", err)
+	}
+
+	if file != nil {
+		file.URL = resp.ContentURI.CUString()
+		return "", file, nil
+	}
+
+	return resp.ContentURI.CUString(), nil, nil
+}
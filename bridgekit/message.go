@@ -0,0 +1,94 @@
+package bridgekit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// SendRemoteMessageInRoom sends the given remote message into the room using the provided sender intent.
+// If the message has a RemoteID, the resulting event ID is recorded so it can be looked up later.
+func (m *BridgeKit[T]) SendRemoteMessageInRoom(ctx context.Context, room *matrix.Room, sender *appservice.IntentAPI, msg *matrix.Message) (*mautrix.RespSendEvent, error) {
+	defer m.trackWork(workSend)()
+
+	if sender == nil {
+		return nil, errors.New("no sender intent passed")
+	}
+
+	var resp *mautrix.RespSendEvent
+	var err error
+	if msg.Timestamp > 0 {
+		resp, err = sender.SendMassagedMessageEvent(ctx, room.MXID, event.EventMessage, &msg.Content, msg.Timestamp)
+	} else {
+		resp, err = sender.SendMessageEvent(ctx, room.MXID, event.EventMessage, &msg.Content)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.RemoteID != "" {
+		if err := m.MapMessage(ctx, room, msg.RemoteID, msg.PartIndex, resp.EventID, sender.UserID, msg.Timestamp); err != nil {
+			zerolog.Ctx(ctx).Err(err).Str("remote_id", msg.RemoteID).Msg("Failed to save message mapping")
+		}
+	}
+
+	return resp, nil
+}
+
+// MapMessage records that the given part of a remote message was bridged as the given Matrix event.
+// Use this when a message was sent without SendRemoteMessageInRoom, or when a Matrix message was bridged to the remote.
+func (m *BridgeKit[T]) MapMessage(ctx context.Context, room *matrix.Room, remoteID string, partIndex int, eventID id.EventID, sender id.UserID, ts int64) error {
+	if ts == 0 {
+		ts = time.Now().UnixMilli()
+	}
+
+	return m.Store.PutMessage(ctx, &matrix.BridgedMessage{
+		RoomID:     room.MXID,
+		RemoteID:   remoteID,
+		PartIndex:  partIndex,
+		EventID:    eventID,
+		SenderMXID: sender,
+		Timestamp:  ts,
+	})
+}
+
+// GetMessageByEventID returns the bridged message for the given Matrix event ID, or nil if it's unknown.
+func (m *BridgeKit[T]) GetMessageByEventID(ctx context.Context, eventID id.EventID) *matrix.BridgedMessage {
+	msg, err := m.Store.GetMessageByEventID(ctx, eventID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("event_id", eventID).Msg("Failed to get message")
+		return nil
+	}
+
+	return msg
+}
+
+// GetMessageByRemoteID returns the given part of a remote message in the room, or nil if it's unknown.
+func (m *BridgeKit[T]) GetMessageByRemoteID(ctx context.Context, room *matrix.Room, remoteID string, partIndex int) *matrix.BridgedMessage {
+	msg, err := m.Store.GetMessageByRemoteID(ctx, room.MXID, remoteID, partIndex)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("remote_id", remoteID).Msg("Failed to get message")
+		return nil
+	}
+
+	return msg
+}
+
+// GetMessagePartsByRemoteID returns all bridged parts of a remote message in the room, ordered by part index.
+func (m *BridgeKit[T]) GetMessagePartsByRemoteID(ctx context.Context, room *matrix.Room, remoteID string) []*matrix.BridgedMessage {
+	msgs, err := m.Store.GetMessagePartsByRemoteID(ctx, room.MXID, remoteID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("remote_id", remoteID).Msg("Failed to get message parts")
+		return nil
+	}
+
+	return msgs
+}
@@ -0,0 +1,106 @@
+package bridgekit
+
+import (
+	"context"
+	"fmt"
+	"maps"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// basePowerLevelPolicy returns the policy from the bridge config, or the default policy if the config doesn't have one
+// or it is invalid.
+func (m *BridgeKit[T]) basePowerLevelPolicy() matrix.PowerLevelPolicy {
+	getter, ok := any(m.Config).(PowerLevelConfigGetter)
+	if !ok {
+		return matrix.DefaultPowerLevelPolicy()
+	}
+
+	policy := getter.PowerLevelPolicy()
+	if err := policy.Validate(); err != nil {
+		m.log.Err(err).Msg("Invalid power level config, using defaults")
+		return matrix.DefaultPowerLevelPolicy()
+	}
+
+	return policy
+}
+
+// GetPowerLevelPolicy returns the power level policy for the given room: the policy from the bridge config,
+// customized by the connector if it implements PowerLevelCustomizer.
+func (m *BridgeKit[T]) GetPowerLevelPolicy(ctx context.Context, room *matrix.Room) matrix.PowerLevelPolicy {
+	policy := m.RoomManager.PowerLevelPolicy
+	// the events map is shared with the room manager, so every room gets its own copy
+	policy.Events = maps.Clone(policy.Events)
+	if customizer, ok := m.Connector.(PowerLevelCustomizer); ok {
+		customizer.CustomizePowerLevelPolicy(ctx, room, &policy)
+	}
+
+	return policy
+}
+
+// SetGhostRoles updates the roles of ghosts in the room, saves the room and applies the changed power levels.
+// Levels that were set by users are left untouched.
+func (m *BridgeKit[T]) SetGhostRoles(ctx context.Context, room *matrix.Room, roles map[id.UserID]matrix.GhostRole) error {
+	for userID, role := range roles {
+		room.SetGhostRole(userID, role)
+	}
+
+	if err := m.Store.PutRoom(ctx, room); err != nil {
+		return fmt.Errorf("failed to save room: %w", err)
+	}
+
+	if room.MXID == "" {
+		return nil
+	}
+
+	_, err := m.RoomManager.SyncGhostPowerLevels(ctx, room, m.GetPowerLevelPolicy(ctx, room))
+	return err
+}
+
+// bridgedRoomUsers returns the joined members of the room that are users of the bridge.
+func (m *BridgeKit[T]) bridgedRoomUsers(ctx context.Context, room *matrix.Room) ([]id.UserID, error) {
+	members, err := m.Bridge.Bot.JoinedMembers(ctx, room.MXID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get joined members: %w", err)
+	}
+
+	var users []id.UserID
+	for userID := range members.Joined {
+		if userID == m.Bridge.Bot.UserID || m.IsGhost(userID) {
+			continue
+		}
+		if m.GetUser(ctx, userID, false) != nil {
+			users = append(users, userID)
+		}
+	}
+
+	return users, nil
+}
+
+// mergePowerLevels applies the generated power levels to the current ones. The defaults and the levels of the events
+// in generated are copied, and the managed users and the bot get their generated level, or the users default if they
+// aren't listed. Other users and events are left untouched.
+func mergePowerLevels(current, generated *event.PowerLevelsEventContent, bot id.UserID, managed []id.UserID) {
+	current.UsersDefault = generated.UsersDefault
+	current.EventsDefault = generated.EventsDefault
+	current.StateDefaultPtr = generated.StateDefaultPtr
+	current.InvitePtr = generated.InvitePtr
+	current.KickPtr = generated.KickPtr
+	current.BanPtr = generated.BanPtr
+	current.RedactPtr = generated.RedactPtr
+
+	if current.Events == nil {
+		current.Events = make(map[string]int)
+	}
+	for eventType, level := range generated.Events {
+		current.Events[eventType] = level
+	}
+
+	for _, userID := range managed {
+		current.SetUserLevel(userID, generated.GetUserLevel(userID))
+	}
+	current.SetUserLevel(bot, generated.GetUserLevel(bot))
+}
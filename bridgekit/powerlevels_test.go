@@ -0,0 +1,62 @@
+package bridgekit
+
+import (
+	"testing"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestMergePowerLevels(t *testing.T) {
+	const (
+		bot   id.UserID = "@bot:example.com"
+		user  id.UserID = "@user:example.com"
+		admin id.UserID = "@test_admin:example.com"
+		ghost id.UserID = "@test_ghost:example.com"
+		other id.UserID = "@other:example.com"
+	)
+
+	room := &matrix.Room{Ghosts: []*matrix.Ghost{{MXID: admin}, {MXID: ghost}}}
+	room.SetGhostRole(admin, matrix.GhostRoleAdmin)
+	policy := matrix.DefaultPowerLevelPolicy()
+	policy.User = 10
+	generated := policy.PowerLevels(bot, room, user)
+
+	current := &event.PowerLevelsEventContent{
+		Users: map[id.UserID]int{
+			bot:   9001,
+			user:  50,
+			ghost: 100,
+			other: 75,
+		},
+		EventsDefault: 50,
+		Events: map[string]int{
+			event.EventMessage.Type: 50,
+			"m.room.topic":          60,
+		},
+	}
+
+	mergePowerLevels(current, generated, bot, []id.UserID{admin, ghost, user})
+
+	wantUsers := map[id.UserID]int{bot: 9001, user: 10, admin: 100, other: 75}
+	if len(current.Users) != len(wantUsers) {
+		t.Fatalf("expected users %v, got %v", wantUsers, current.Users)
+	}
+	for userID, level := range wantUsers {
+		if current.Users[userID] != level {
+			t.Errorf("expected level %d for %s, got %d", level, userID, current.Users[userID])
+		}
+	}
+
+	if current.EventsDefault != policy.EventsDefault || current.StateDefault() != policy.StateDefault {
+		t.Errorf("expected the defaults of the policy, got %d and %d", current.EventsDefault, current.StateDefault())
+	}
+	if current.Events[event.EventMessage.Type] != 0 {
+		t.Errorf("expected the message level of the policy, got %d", current.Events[event.EventMessage.Type])
+	}
+	if current.Events["m.room.topic"] != 60 {
+		t.Errorf("expected events the policy doesn't mention to be kept, got %v", current.Events)
+	}
+}
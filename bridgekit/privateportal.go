@@ -0,0 +1,110 @@
+package bridgekit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/id"
+)
+
+// CreatePrivatePortal is called when a Matrix user starts a direct chat with a ghost.
+// The connector resolves the remote chat through PrivateChatResolver, then the room the user created
+// is adopted as the portal. If that fails, a new portal room is created instead.
+// Errors are reported to the user in the room.
+func (m *BridgeKit[T]) CreatePrivatePortal(roomID id.RoomID, user bridge.User, ghost bridge.Ghost) {
+	log := m.log.With().
+		Str("action", "create private portal").
+		Stringer("room_id", roomID).
+		Stringer("user_id", user.GetMXID()).
+		Logger()
+	ctx := log.WithContext(m.parentCtx)
+	intent := ghost.DefaultIntent()
+
+	mxUser, userOk := user.(*matrix.User)
+	mxGhost, ghostOk := ghost.(*matrix.Ghost)
+	if !userOk || !ghostOk {
+		m.rejectPrivatePortal(ctx, roomID, intent, errors.New("unsupported user or ghost"))
+		return
+	}
+
+	resolver, ok := m.Connector.(PrivateChatResolver)
+	if !ok {
+		m.rejectPrivatePortal(ctx, roomID, intent, errors.New("this bridge doesn't support starting chats from Matrix"))
+		return
+	}
+
+	room, err := resolver.ResolvePrivateChat(ctx, mxUser, mxGhost)
+	if err != nil {
+		m.rejectPrivatePortal(ctx, roomID, intent, fmt.Errorf("failed to start chat: %w", err))
+		return
+	} else if room == nil {
+		m.rejectPrivatePortal(ctx, roomID, intent, errors.New("failed to start chat: no remote chat found"))
+		return
+	}
+	m.RoomManager.LoadRoom(room)
+
+	if room.MXID != "" && room.MXID != roomID {
+		log.Debug().Stringer("portal_mxid", room.MXID).Msg("Private chat already has a portal")
+		if err := m.RoomManager.AddUserToRoom(ctx, room.MXID, mxUser); err != nil {
+			log.Err(err).Msg("Failed to invite user to existing portal")
+		}
+		m.rejectPrivatePortal(ctx, roomID, intent, fmt.Errorf("you already have a chat with this user at %s", room.MXID.URI(m.Bridge.Config.Homeserver.Domain).MatrixToURL()))
+		return
+	}
+
+	if err := m.adoptPrivatePortal(ctx, roomID, intent, room); err != nil {
+		log.Warn().Err(err).Msg("Failed to adopt room as portal, creating a new one")
+		room.MXID = ""
+		if _, _, err := m.CreateRoom(ctx, room, mxUser, id.ContentURI{}); err != nil {
+			m.rejectPrivatePortal(ctx, roomID, intent, fmt.Errorf("failed to create portal: %w", err))
+			return
+		}
+
+		m.rejectPrivatePortal(ctx, roomID, intent, errors.New("couldn't use this room for the chat, created a new room instead"))
+	}
+}
+
+// adoptPrivatePortal turns the room the user created into the portal for the resolved remote chat.
+func (m *BridgeKit[T]) adoptPrivatePortal(ctx context.Context, roomID id.RoomID, intent *appservice.IntentAPI, room *matrix.Room) error {
+	if err := intent.EnsureInvited(ctx, roomID, m.Bot.UserID); err != nil {
+		return fmt.Errorf("failed to invite bridge bot: %w", err)
+	}
+	if err := m.Bot.EnsureJoined(ctx, roomID); err != nil {
+		return fmt.Errorf("failed to join bridge bot: %w", err)
+	}
+
+	room.MXID = roomID
+	room.PrivateChat = true
+	if encrypted, err := m.StateStore.IsEncrypted(ctx, roomID); err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to check if room is encrypted")
+	} else {
+		room.Encrypted = encrypted
+	}
+
+	if err := m.Store.PutRoom(ctx, room); err != nil {
+		return fmt.Errorf("failed to save room: %w", err)
+	}
+
+	m.UpdateBridgeInfo(ctx, room)
+	return nil
+}
+
+// rejectPrivatePortal tells the user why the room couldn't be used as a portal and leaves it.
+func (m *BridgeKit[T]) rejectPrivatePortal(ctx context.Context, roomID id.RoomID, intent *appservice.IntentAPI, err error) {
+	log := zerolog.Ctx(ctx)
+	log.Debug().Err(err).Msg("Rejecting private portal")
+	if _, sendErr := intent.SendNotice(ctx, roomID, err.Error()); sendErr != nil {
+		log.Err(sendErr).Msg("Failed to send notice")
+	}
+
+	if _, leaveErr := intent.LeaveRoom(ctx, roomID, &mautrix.ReqLeave{Reason: err.Error()}); leaveErr != nil {
+		log.Err(leaveErr).Msg("Failed to leave room")
+	}
+}
@@ -0,0 +1,158 @@
+package bridgekit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type reactionKey struct {
+	target id.EventID
+	sender id.UserID
+	key    string
+}
+
+// reactionLock serialises sending and removing the same reaction, so that the store check and the send can't race.
+// It's removed from BridgeKit.reactionLocks once nobody holds or waits for it.
+type reactionLock struct {
+	lock sync.Mutex
+	refs int
+}
+
+// lockReaction locks the reaction of the sender with the key on the target event, and returns the unlock function.
+func (m *BridgeKit[T]) lockReaction(target id.EventID, sender id.UserID, key string) func() {
+	k := reactionKey{target: target, sender: sender, key: key}
+
+	m.reactionLocksLock.Lock()
+	l, ok := m.reactionLocks[k]
+	if !ok {
+		l = &reactionLock{}
+		m.reactionLocks[k] = l
+	}
+	l.refs++
+	m.reactionLocksLock.Unlock()
+
+	l.lock.Lock()
+	return func() {
+		l.lock.Unlock()
+
+		m.reactionLocksLock.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(m.reactionLocks, k)
+		}
+		m.reactionLocksLock.Unlock()
+	}
+}
+
+// SendReaction reacts to the target event with the given key, using the provided sender intent.
+// If the sender already reacted with the same key, no new reaction is sent and the existing reaction event ID is returned.
+func (m *BridgeKit[T]) SendReaction(ctx context.Context, room *matrix.Room, sender *appservice.IntentAPI, target id.EventID, key string) (id.EventID, error) {
+	defer m.trackWork(workSend)()
+
+	if sender == nil {
+		return "", errors.New("no sender intent passed")
+	}
+	defer m.lockReaction(target, sender.UserID, key)()
+
+	existing, err := m.Store.GetReaction(ctx, target, sender.UserID, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to check for existing reaction: %w", err)
+	} else if existing != nil {
+		zerolog.Ctx(ctx).Debug().Stringer("event_id", existing.EventID).Msg("Skipping duplicate reaction")
+		return existing.EventID, nil
+	}
+
+	content := &event.ReactionEventContent{
+		RelatesTo: event.RelatesTo{
+			Type:    event.RelAnnotation,
+			EventID: target,
+			Key:     key,
+		},
+	}
+	resp, err := sender.SendMessageEvent(ctx, room.MXID, event.EventReaction, content)
+	if err != nil {
+		return "", err
+	}
+
+	err = m.Store.PutReaction(ctx, &matrix.Reaction{
+		RoomID:        room.MXID,
+		TargetEventID: target,
+		SenderMXID:    sender.UserID,
+		Key:           key,
+		EventID:       resp.EventID,
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("event_id", resp.EventID).Msg("Failed to save reaction")
+	}
+
+	return resp.EventID, nil
+}
+
+// SendGhostReaction reacts to the target event as the given ghost.
+func (m *BridgeKit[T]) SendGhostReaction(ctx context.Context, room *matrix.Room, ghost *matrix.Ghost, target id.EventID, key string) (id.EventID, error) {
+	return m.SendReaction(ctx, room, m.GhostMaster.AsGhost(ghost), target, key)
+}
+
+// SendUserReaction reacts to the target event as the given user, either through double puppeting or the user's ghost.
+func (m *BridgeKit[T]) SendUserReaction(ctx context.Context, room *matrix.Room, user *matrix.User, target id.EventID, key string) (id.EventID, error) {
+	return m.SendReaction(ctx, room, m.GhostMaster.AsUserGhost(ctx, user), target, key)
+}
+
+// RemoveReaction redacts the reaction with the given key that the sender placed on the target event.
+// Nothing happens if there is no such reaction.
+func (m *BridgeKit[T]) RemoveReaction(ctx context.Context, room *matrix.Room, sender *appservice.IntentAPI, target id.EventID, key string) error {
+	defer m.trackWork(workSend)()
+
+	if sender == nil {
+		return errors.New("no sender intent passed")
+	}
+	defer m.lockReaction(target, sender.UserID, key)()
+
+	reaction, err := m.Store.GetReaction(ctx, target, sender.UserID, key)
+	if err != nil {
+		return fmt.Errorf("failed to get reaction: %w", err)
+	} else if reaction == nil {
+		return nil
+	}
+
+	if _, err := sender.RedactEvent(ctx, room.MXID, reaction.EventID); err != nil {
+		return err
+	}
+
+	return m.Store.DeleteReaction(ctx, reaction)
+}
+
+// RemoveGhostReaction removes a reaction that was placed by the given ghost.
+func (m *BridgeKit[T]) RemoveGhostReaction(ctx context.Context, room *matrix.Room, ghost *matrix.Ghost, target id.EventID, key string) error {
+	return m.RemoveReaction(ctx, room, m.GhostMaster.AsGhost(ghost), target, key)
+}
+
+// RemoveUserReaction removes a reaction that was placed by the given user.
+func (m *BridgeKit[T]) RemoveUserReaction(ctx context.Context, room *matrix.Room, user *matrix.User, target id.EventID, key string) error {
+	return m.RemoveReaction(ctx, room, m.GhostMaster.AsUserGhost(ctx, user), target, key)
+}
+
+// forgetRedactedReaction removes the stored reaction if the redacted event is one, so that the same reaction
+// can be sent again after it was removed on the Matrix side.
+func (m *BridgeKit[T]) forgetRedactedReaction(ctx context.Context, redacts id.EventID) {
+	reaction, err := m.Store.GetReactionByEventID(ctx, redacts)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("redacts", redacts).Msg("Failed to get redacted reaction")
+		return
+	} else if reaction == nil {
+		return
+	}
+
+	if err := m.Store.DeleteReaction(ctx, reaction); err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("redacts", redacts).Msg("Failed to delete redacted reaction")
+	}
+}
@@ -0,0 +1,51 @@
+package bridgekit
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+)
+
+// TestSendReactionConcurrently sends the same reaction from several goroutines. It is meant to be run with -race.
+func TestSendReactionConcurrently(t *testing.T) {
+	hs := &testHomeserver{}
+	m := newTestHomeserverBridgeKit(t, hs)
+	room := &matrix.Room{MXID: "!room:example.com"}
+	sender := m.AS.Intent("@test_alice:example.com")
+
+	const senders = 10
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	eventIDs := make(map[string]bool)
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			eventID, err := m.SendReaction(context.Background(), room, sender, "$target", "👍")
+			if err != nil {
+				t.Errorf("failed to send reaction: %v", err)
+				return
+			}
+
+			lock.Lock()
+			eventIDs[eventID.String()] = true
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	hs.lock.Lock()
+	sends := len(hs.sends)
+	hs.lock.Unlock()
+	if sends != 1 || len(eventIDs) != 1 {
+		t.Fatalf("expected the reaction to be sent once, got %d sends and event IDs %v", sends, eventIDs)
+	}
+
+	m.reactionLocksLock.Lock()
+	defer m.reactionLocksLock.Unlock()
+	if len(m.reactionLocks) != 0 {
+		t.Fatalf("expected unused reaction locks to be removed, %d are left", len(m.reactionLocks))
+	}
+}
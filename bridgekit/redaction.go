@@ -0,0 +1,47 @@
+package bridgekit
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+)
+
+// RedactMessage redacts all Matrix events that the given remote message was bridged as.
+// Each part is redacted as its original sender (ghost, user ghost or double puppet), falling back to the bot
+// if that fails, for example because the double puppet is no longer valid.
+func (m *BridgeKit[T]) RedactMessage(ctx context.Context, room *matrix.Room, remoteID string, reason string) error {
+	defer m.trackWork(workSend)()
+
+	parts := m.GetMessagePartsByRemoteID(ctx, room, remoteID)
+	if len(parts) == 0 {
+		return fmt.Errorf("%w %s", ErrUnknownMessage, remoteID)
+	}
+
+	for _, part := range parts {
+		if err := m.redactBridgedMessage(ctx, room, part, reason); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *BridgeKit[T]) redactBridgedMessage(ctx context.Context, room *matrix.Room, msg *matrix.BridgedMessage, reason string) error {
+	req := mautrix.ReqRedact{Reason: reason}
+
+	intent := m.intentForSender(ctx, msg.SenderMXID)
+	_, err := intent.RedactEvent(ctx, room.MXID, msg.EventID, req)
+	if err != nil && intent != m.Bot {
+		zerolog.Ctx(ctx).Warn().Err(err).Stringer("event_id", msg.EventID).Msg("Failed to redact as original sender, retrying as bridge bot")
+		_, err = m.Bot.RedactEvent(ctx, room.MXID, msg.EventID, req)
+	}
+	if err != nil {
+		return err
+	}
+
+	return m.Store.DeleteMessage(ctx, msg)
+}
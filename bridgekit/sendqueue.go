@@ -0,0 +1,283 @@
+package bridgekit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ErrBridgeStopping is the result of sends that are queued while the bridge is stopping.
+var ErrBridgeStopping = errors.New("bridge is stopping")
+
+// SendQueueConfig controls how queued sends are retried.
+// Zero values are replaced with the defaults.
+type SendQueueConfig struct {
+	// MaxRetries is the number of times a send is retried after a transient homeserver error. Defaults to 5.
+	MaxRetries int
+	// RetryDelay is the delay before the first retry, doubling with every retry. Defaults to 1 second.
+	RetryDelay time.Duration
+	// MaxDelay caps the exponentially growing delay. Defaults to 30 seconds.
+	MaxDelay time.Duration
+}
+
+func (sc SendQueueConfig) maxRetries() int {
+	if sc.MaxRetries <= 0 {
+		return 5
+	}
+
+	return sc.MaxRetries
+}
+
+// delay returns the backoff delay before the given retry, counting from 1.
+func (sc SendQueueConfig) delay(retry int) time.Duration {
+	delay, maxDelay := sc.RetryDelay, sc.MaxDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	if maxDelay <= 0 {
+		maxDelay = 30 * time.Second
+	}
+
+	for i := 1; i < retry && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, maxDelay)
+}
+
+// SendFunc sends something to Matrix and returns the resulting event ID.
+type SendFunc func(ctx context.Context) (id.EventID, error)
+
+// SendFuture is the result of a queued send.
+type SendFuture struct {
+	done    chan struct{}
+	eventID id.EventID
+	err     error
+}
+
+func newSendFuture() *SendFuture {
+	return &SendFuture{done: make(chan struct{})}
+}
+
+func (f *SendFuture) resolve(eventID id.EventID, err error) {
+	f.eventID, f.err = eventID, err
+	close(f.done)
+}
+
+// Done returns a channel that is closed once the send finished.
+func (f *SendFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the send finished and returns the resulting event ID, or until the context is done.
+func (f *SendFuture) Wait(ctx context.Context) (id.EventID, error) {
+	select {
+	case <-f.done:
+		return f.eventID, f.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Then calls fn with the result of the send once it finished. fn is called on its own goroutine.
+func (f *SendFuture) Then(fn func(eventID id.EventID, err error)) {
+	go func() {
+		<-f.done
+		fn(f.eventID, f.err)
+	}()
+}
+
+type queuedSend struct {
+	ctx    context.Context
+	send   SendFunc
+	future *SendFuture
+	done   func()
+}
+
+// sendQueue sends the queued events of a single room one after the other. The worker goroutine only runs while
+// there are sends in the queue, and the queue is removed from BridgeKit.sendQueues when it stops.
+type sendQueue struct {
+	roomID id.RoomID
+	sends  []*queuedSend
+}
+
+// QueueSend queues a send in the room. Sends in the same room are made in the order they were queued, while
+// different rooms are sent in parallel. Transient homeserver errors are retried as configured in BridgeKit.SendQueue.
+//
+// The send gets a context that carries the logger of ctx, but is only cancelled when the bridge stops.
+// Once the bridge is stopping, only sends queued while handling a Matrix event are accepted, other sends fail with
+// ErrBridgeStopping.
+func (m *BridgeKit[T]) QueueSend(ctx context.Context, room *matrix.Room, send SendFunc) *SendFuture {
+	future := newSendFuture()
+	if m.inFlight.isStopping() && !isInFlight(ctx) {
+		zerolog.Ctx(ctx).Warn().Stringer("room_id", room.MXID).Msg("Not queueing send as the bridge is stopping")
+		future.resolve("", ErrBridgeStopping)
+		return future
+	}
+
+	done, _ := m.inFlight.start(workSend)
+	item := &queuedSend{
+		ctx:    zerolog.Ctx(ctx).With().Stringer("room_id", room.MXID).Logger().WithContext(m.parentCtx),
+		send:   send,
+		future: future,
+		done:   done,
+	}
+
+	m.sendQueuesLock.Lock()
+	defer m.sendQueuesLock.Unlock()
+
+	q, ok := m.sendQueues[room.MXID]
+	if !ok {
+		q = &sendQueue{roomID: room.MXID}
+		m.sendQueues[room.MXID] = q
+		go m.runSendQueue(q)
+	}
+	q.sends = append(q.sends, item)
+
+	return future
+}
+
+func (m *BridgeKit[T]) runSendQueue(q *sendQueue) {
+	for {
+		m.sendQueuesLock.Lock()
+		if len(q.sends) == 0 {
+			delete(m.sendQueues, q.roomID)
+			m.sendQueuesLock.Unlock()
+			return
+		}
+		item := q.sends[0]
+		q.sends[0] = nil
+		q.sends = q.sends[1:]
+		m.sendQueuesLock.Unlock()
+
+		eventID, err := m.sendWithRetries(item.ctx, item.send)
+		item.future.resolve(eventID, err)
+		item.done()
+	}
+}
+
+func (m *BridgeKit[T]) sendWithRetries(ctx context.Context, send SendFunc) (eventID id.EventID, err error) {
+	log := zerolog.Ctx(ctx)
+	defer func() {
+		if p := recover(); p != nil {
+			log.Error().Interface(zerolog.ErrorFieldName, p).Msg("Panic in queued send")
+			err = errors.New("panic in queued send")
+		}
+	}()
+
+	for retry := 0; ; retry++ {
+		eventID, err = send(ctx)
+		if err == nil || !isTransientSendError(err) || retry >= m.SendQueue.maxRetries() {
+			return eventID, err
+		}
+
+		delay := m.SendQueue.delay(retry + 1)
+		log.Warn().Err(err).Int("retry", retry+1).Dur("delay", delay).Msg("Transient error while sending, retrying")
+		if !m.inFlight.wait(ctx, delay) {
+			log.Warn().Msg("Not retrying send as the bridge is stopping")
+			return "", err
+		}
+	}
+}
+
+// isTransientSendError returns true for errors where the homeserver certainly didn't apply the send, so that
+// retrying can't duplicate the event: rate limits, and connections that failed before the request was sent.
+// Server errors and timeouts aren't retried, as the event may have been sent anyway. The HTTP client of
+// mautrix already retries those with the same transaction ID.
+func isTransientSendError(err error) bool {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+
+	if httpErr.Response != nil {
+		return httpErr.Response.StatusCode == http.StatusTooManyRequests
+	}
+
+	var opErr *net.OpError
+	return errors.As(httpErr.WrappedError, &opErr) && opErr.Op == "dial"
+}
+
+// QueueRemoteMessage queues SendRemoteMessageInRoom.
+func (m *BridgeKit[T]) QueueRemoteMessage(ctx context.Context, room *matrix.Room, sender *appservice.IntentAPI, msg *matrix.Message) *SendFuture {
+	return m.QueueSend(ctx, room, func(ctx context.Context) (id.EventID, error) {
+		resp, err := m.SendRemoteMessageInRoom(ctx, room, sender, msg)
+		if err != nil {
+			return "", err
+		}
+
+		return resp.EventID, nil
+	})
+}
+
+// QueueMessage queues SendMessageInRoom.
+func (m *BridgeKit[T]) QueueMessage(ctx context.Context, room *matrix.Room, sender *appservice.IntentAPI, content *event.MessageEventContent) *SendFuture {
+	return m.QueueSend(ctx, room, func(ctx context.Context) (id.EventID, error) {
+		resp, err := m.SendMessageInRoom(ctx, room, sender, content)
+		if err != nil {
+			return "", err
+		}
+
+		return resp.EventID, nil
+	})
+}
+
+// QueueRemoteEdit queues SendRemoteEditInRoom. The original message is looked up when the edit is sent,
+// so an edit queued right after its message works.
+func (m *BridgeKit[T]) QueueRemoteEdit(ctx context.Context, room *matrix.Room, remoteID string, partIndex int, content *event.MessageEventContent, ts int64) *SendFuture {
+	return m.QueueSend(ctx, room, func(ctx context.Context) (id.EventID, error) {
+		resp, err := m.SendRemoteEditInRoom(ctx, room, remoteID, partIndex, content, ts)
+		if err != nil {
+			return "", err
+		}
+
+		return resp.EventID, nil
+	})
+}
+
+// QueueReaction queues SendReaction.
+func (m *BridgeKit[T]) QueueReaction(ctx context.Context, room *matrix.Room, sender *appservice.IntentAPI, target id.EventID, key string) *SendFuture {
+	return m.QueueSend(ctx, room, func(ctx context.Context) (id.EventID, error) {
+		return m.SendReaction(ctx, room, sender, target, key)
+	})
+}
+
+// QueueRemoveReaction queues RemoveReaction. The future has no event ID.
+func (m *BridgeKit[T]) QueueRemoveReaction(ctx context.Context, room *matrix.Room, sender *appservice.IntentAPI, target id.EventID, key string) *SendFuture {
+	return m.QueueSend(ctx, room, func(ctx context.Context) (id.EventID, error) {
+		return "", m.RemoveReaction(ctx, room, sender, target, key)
+	})
+}
+
+// QueueRedaction queues RedactMessage. The future has no event ID.
+func (m *BridgeKit[T]) QueueRedaction(ctx context.Context, room *matrix.Room, remoteID string, reason string) *SendFuture {
+	return m.QueueSend(ctx, room, func(ctx context.Context) (id.EventID, error) {
+		return "", m.RedactMessage(ctx, room, remoteID, reason)
+	})
+}
+
+// QueueStateEvent queues a state event in the room, like a name, topic or avatar change, using the provided sender intent.
+func (m *BridgeKit[T]) QueueStateEvent(ctx context.Context, room *matrix.Room, sender *appservice.IntentAPI, eventType event.Type, stateKey string, content any) *SendFuture {
+	return m.QueueSend(ctx, room, func(ctx context.Context) (id.EventID, error) {
+		if sender == nil {
+			return "", errors.New("no sender intent passed")
+		}
+
+		resp, err := sender.SendStateEvent(ctx, room.MXID, eventType, stateKey, content)
+		if err != nil {
+			return "", err
+		}
+
+		return resp.EventID, nil
+	})
+}
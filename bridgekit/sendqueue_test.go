@@ -0,0 +1,233 @@
+package bridgekit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestSendQueueConfigDelay(t *testing.T) {
+	tests := []struct {
+		name   string
+		config SendQueueConfig
+		retry  int
+		want   time.Duration
+	}{
+		{"first retry", SendQueueConfig{}, 1, time.Second},
+		{"doubles", SendQueueConfig{}, 4, 8 * time.Second},
+		{"capped", SendQueueConfig{}, 10, 30 * time.Second},
+		{"huge retry doesn't overflow", SendQueueConfig{}, 1000, 30 * time.Second},
+		{"custom", SendQueueConfig{RetryDelay: 10 * time.Millisecond, MaxDelay: time.Second}, 3, 40 * time.Millisecond},
+		{"custom cap", SendQueueConfig{RetryDelay: 300 * time.Millisecond, MaxDelay: time.Second}, 3, time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.delay(tt.retry); got != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func httpError(status int, wrapped error) error {
+	err := mautrix.HTTPError{WrappedError: wrapped}
+	if status != 0 {
+		err.Response = &http.Response{StatusCode: status}
+	}
+
+	return err
+}
+
+func TestIsTransientSendError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"plain error", errors.New("failed"), false},
+		{"rate limited", httpError(http.StatusTooManyRequests, nil), true},
+		{"wrapped rate limit", fmt.Errorf("failed to send: %w", httpError(http.StatusTooManyRequests, nil)), true},
+		{"server error", httpError(http.StatusInternalServerError, nil), false},
+		{"bad gateway", httpError(http.StatusBadGateway, nil), false},
+		{"forbidden", httpError(http.StatusForbidden, nil), false},
+		{"dial failed", httpError(0, &net.OpError{Op: "dial", Err: errors.New("connection refused")}), true},
+		{"read failed", httpError(0, &net.OpError{Op: "read", Err: errors.New("connection reset")}), false},
+		{"timeout", httpError(0, context.DeadlineExceeded), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransientSendError(tt.err); got != tt.want {
+				t.Fatalf("expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSendWithRetries(t *testing.T) {
+	rateLimited := httpError(http.StatusTooManyRequests, nil)
+	serverError := httpError(http.StatusInternalServerError, nil)
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", nil, 1, nil},
+		{"retried until success", []error{rateLimited, rateLimited}, 3, nil},
+		{"not retried", []error{serverError}, 1, serverError},
+		{"gives up", []error{rateLimited, rateLimited, rateLimited, rateLimited}, 3, rateLimited},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestBridgeKit(t, testConnector{})
+			m.SendQueue = SendQueueConfig{MaxRetries: 2, RetryDelay: time.Millisecond}
+
+			calls := 0
+			eventID, err := m.sendWithRetries(context.Background(), func(ctx context.Context) (id.EventID, error) {
+				calls++
+				if calls <= len(tt.errs) {
+					return "", tt.errs[calls-1]
+				}
+				return "$event", nil
+			})
+
+			if calls != tt.wantCalls {
+				t.Fatalf("expected %d calls, got %d", tt.wantCalls, calls)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+			} else if err != nil || eventID != "$event" {
+				t.Fatalf("expected event, got %s, %v", eventID, err)
+			}
+		})
+	}
+}
+
+// TestQueueSendRace queues sends for several rooms from many goroutines. It is meant to be run with -race.
+func TestQueueSendRace(t *testing.T) {
+	m := newTestBridgeKit(t, testConnector{})
+	m.SendQueue = SendQueueConfig{RetryDelay: time.Millisecond}
+
+	const rooms, sendsPerRoom = 4, 50
+	var lock sync.Mutex
+	sent := make(map[id.RoomID][]int)
+
+	var wg sync.WaitGroup
+	futures := make(chan *SendFuture, rooms*sendsPerRoom)
+	for r := 0; r < rooms; r++ {
+		room := &matrix.Room{MXID: id.RoomID(fmt.Sprintf("!room%d:example.com", r))}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < sendsPerRoom; i++ {
+				attempts := 0
+				futures <- m.QueueSend(context.Background(), room, func(ctx context.Context) (id.EventID, error) {
+					// every tenth send is rate limited once
+					attempts++
+					if i%10 == 0 && attempts == 1 {
+						return "", httpError(http.StatusTooManyRequests, nil)
+					}
+
+					lock.Lock()
+					sent[room.MXID] = append(sent[room.MXID], i)
+					lock.Unlock()
+					return id.EventID(fmt.Sprintf("$%d", i)), nil
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	close(futures)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for future := range futures {
+		if _, err := future.Wait(ctx); err != nil {
+			t.Fatalf("send failed: %v", err)
+		}
+	}
+
+	lock.Lock()
+	for roomID, order := range sent {
+		if len(order) != sendsPerRoom {
+			t.Errorf("expected %d sends in %s, got %d", sendsPerRoom, roomID, len(order))
+		}
+		for i, n := range order {
+			if n != i {
+				t.Errorf("sends in %s are out of order: %v", roomID, order)
+				break
+			}
+		}
+	}
+	lock.Unlock()
+
+	// the workers remove their queue after resolving the last future
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		m.sendQueuesLock.Lock()
+		remaining := len(m.sendQueues)
+		m.sendQueuesLock.Unlock()
+		if remaining == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("expected idle send queues to be removed, %d are left", remaining)
+		}
+	}
+}
+
+func TestQueueSendWhileStopping(t *testing.T) {
+	m := newTestBridgeKit(t, testConnector{})
+	room := &matrix.Room{MXID: "!room:example.com"}
+
+	// keep the tracker from draining, so that it stays stopping
+	done, _ := m.inFlight.start(workMatrixEvent)
+	defer done()
+	drainCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.inFlight.drain(drainCtx)
+	<-m.inFlight.stopped
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		wantSent bool
+		wantErr  error
+	}{
+		{"new send", context.Background(), false, ErrBridgeStopping},
+		{"send of an in-flight event", withInFlight(context.Background()), true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := false
+			future := m.QueueSend(tt.ctx, room, func(ctx context.Context) (id.EventID, error) {
+				sent = true
+				return "$event", nil
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if _, err := future.Wait(ctx); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if sent != tt.wantSent {
+				t.Fatalf("expected sent %t, got %t", tt.wantSent, sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package bridgekit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// defaultShutdownTimeout is used when BridgeKit.ShutdownTimeout isn't set.
+const defaultShutdownTimeout = 15 * time.Second
+
+// Kinds of in-flight work that are drained on shutdown.
+const (
+	workMatrixEvent = "matrix_event"
+	workSend        = "send"
+	workMedia       = "media"
+	workBackfill    = "backfill"
+)
+
+// inFlightTracker counts running work by kind, so that shutdown can wait for it to finish.
+type inFlightTracker struct {
+	lock     sync.Mutex
+	counts   map[string]int
+	total    int
+	stopping bool
+	drained  chan struct{}
+	// stopped is closed when stopping starts, and deadline is when the shutdown timeout ends
+	stopped  chan struct{}
+	deadline time.Time
+}
+
+func newInFlightTracker() *inFlightTracker {
+	return &inFlightTracker{
+		counts:  make(map[string]int),
+		drained: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// start registers a piece of work and returns the function to call when it's done.
+// New Matrix events are refused once the tracker is stopping, other work is still accepted
+// so that in-flight events can finish sending.
+func (t *inFlightTracker) start(kind string) (done func(), ok bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.stopping && kind == workMatrixEvent {
+		return nil, false
+	}
+
+	t.counts[kind]++
+	t.total++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { t.finish(kind) })
+	}, true
+}
+
+func (t *inFlightTracker) finish(kind string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.counts[kind]--
+	if t.counts[kind] == 0 {
+		delete(t.counts, kind)
+	}
+	t.total--
+	if t.stopping && t.total == 0 {
+		t.closeDrained()
+	}
+}
+
+// closeDrained must be called with the lock held.
+func (t *inFlightTracker) closeDrained() {
+	select {
+	case <-t.drained:
+	default:
+		close(t.drained)
+	}
+}
+
+// drain stops accepting Matrix events and waits until all work finished or the context is done.
+// It returns the work that was still running, keyed by kind.
+func (t *inFlightTracker) drain(ctx context.Context) map[string]int {
+	t.lock.Lock()
+	if !t.stopping {
+		t.stopping = true
+		t.deadline, _ = ctx.Deadline()
+		close(t.stopped)
+	}
+	if t.total == 0 {
+		t.closeDrained()
+	}
+	t.lock.Unlock()
+
+	select {
+	case <-t.drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	remaining := make(map[string]int, len(t.counts))
+	for kind, count := range t.counts {
+		remaining[kind] = count
+	}
+
+	return remaining
+}
+
+// wait sleeps for the given delay before work is retried. It returns false if the context is done, or if the bridge
+// is stopping and the delay would end after the shutdown deadline, so that retries don't get cut off by the timeout.
+func (t *inFlightTracker) wait(ctx context.Context, delay time.Duration) bool {
+	end := time.Now().Add(delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-t.stopped:
+	}
+
+	t.lock.Lock()
+	deadline := t.deadline
+	t.lock.Unlock()
+	if !deadline.IsZero() && end.After(deadline) {
+		return false
+	}
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// isStopping returns whether the tracker started draining.
+func (t *inFlightTracker) isStopping() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.stopping
+}
+
+type inFlightKey struct{}
+
+// withInFlight marks the context of a tracked Matrix event, so that the sends it queues are accepted while stopping.
+func withInFlight(ctx context.Context) context.Context {
+	return context.WithValue(ctx, inFlightKey{}, true)
+}
+
+func isInFlight(ctx context.Context) bool {
+	inFlight, _ := ctx.Value(inFlightKey{}).(bool)
+	return inFlight
+}
+
+// trackWork registers outgoing work, such as sending a message, so that shutdown waits for it.
+func (m *BridgeKit[T]) trackWork(kind string) func() {
+	done, _ := m.inFlight.start(kind)
+	return done
+}
+
+// shutdown stops accepting Matrix events, waits for in-flight work up to the shutdown timeout,
+// disconnects the remote sessions, flushes the bridge states of the users and logs whatever had to be abandoned.
+func (m *BridgeKit[T]) shutdown() {
+	timeout := m.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	m.log.Info().Dur("timeout", timeout).Msg("Stopping bridge, waiting for in-flight work")
+	abandoned := m.inFlight.drain(ctx)
+	m.disconnectAllUsers(ctx)
+	m.flushUserBridgeStates(ctx)
+
+	if len(abandoned) > 0 {
+		dict := zerolog.Dict()
+		for kind, count := range abandoned {
+			dict.Int(kind, count)
+		}
+		m.log.Warn().Dict("abandoned", dict).Msg("Shutdown timeout reached, abandoning in-flight work")
+	} else {
+		m.log.Info().Msg("All in-flight work finished")
+	}
+}
+
+// disconnectAllUsers ends all remote sessions, waiting for them until the context is done.
+func (m *BridgeKit[T]) disconnectAllUsers(ctx context.Context) {
+	m.sessionsLock.Lock()
+	sessions := make([]*userSession, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	m.sessionsLock.Unlock()
+	if len(sessions) == 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for _, session := range sessions {
+			m.DisconnectUser(session.user)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		m.log.Warn().Msg("Timed out disconnecting remote sessions")
+	}
+}
@@ -0,0 +1,109 @@
+package bridgekit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestInFlightTrackerDrain(t *testing.T) {
+	tracker := newInFlightTracker()
+	doneEvent, ok := tracker.start(workMatrixEvent)
+	if !ok {
+		t.Fatal("expected Matrix events to be accepted before stopping")
+	}
+	doneSend, _ := tracker.start(workSend)
+
+	drained := make(chan map[string]int)
+	go func() {
+		drained <- tracker.drain(context.Background())
+	}()
+	<-tracker.stopped
+
+	if _, ok := tracker.start(workMatrixEvent); ok {
+		t.Fatal("expected Matrix events to be refused while stopping")
+	}
+	doneRetry, ok := tracker.start(workSend)
+	if !ok {
+		t.Fatal("expected sends to be accepted while stopping")
+	}
+
+	doneEvent()
+	doneEvent()
+	doneSend()
+	select {
+	case <-drained:
+		t.Fatal("expected drain to wait for the remaining send")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	doneRetry()
+	if remaining := <-drained; remaining != nil {
+		t.Fatalf("expected everything to finish, got %v", remaining)
+	}
+}
+
+func TestInFlightTrackerDrainTimeout(t *testing.T) {
+	tracker := newInFlightTracker()
+	tracker.start(workSend)
+	tracker.start(workSend)
+	done, _ := tracker.start(workMedia)
+	done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	remaining := tracker.drain(ctx)
+	if len(remaining) != 1 || remaining[workSend] != 2 {
+		t.Fatalf("expected 2 abandoned sends, got %v", remaining)
+	}
+}
+
+func TestInFlightTrackerWait(t *testing.T) {
+	tests := []struct {
+		name     string
+		delay    time.Duration
+		stop     bool
+		timeout  time.Duration
+		cancel   bool
+		want     bool
+		maxSlept time.Duration
+	}{
+		{name: "not stopping", delay: 5 * time.Millisecond, want: true},
+		{name: "cancelled", delay: time.Minute, cancel: true, want: false, maxSlept: time.Second},
+		{name: "stopping with time left", delay: 5 * time.Millisecond, stop: true, timeout: time.Minute, want: true},
+		{name: "delay past shutdown deadline", delay: time.Minute, stop: true, timeout: time.Second, want: false, maxSlept: time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newInFlightTracker()
+			if tt.stop {
+				// keep the tracker from draining, so that it stays stopping
+				tracker.start(workSend)
+				ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+				defer cancel()
+				go tracker.drain(ctx)
+				<-tracker.stopped
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+
+			start := time.Now()
+			if got := tracker.wait(ctx, tt.delay); got != tt.want {
+				t.Fatalf("expected %t, got %t", tt.want, got)
+			}
+
+			slept := time.Since(start)
+			if tt.want && slept < tt.delay {
+				t.Fatalf("expected to sleep for %s, slept %s", tt.delay, slept)
+			} else if tt.maxSlept > 0 && slept > tt.maxSlept {
+				t.Fatalf("expected to return early, slept %s", slept)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package bridgekit
+
+import (
+	"context"
+
+	"github.com/dvcrn/matrix-bridgekit/database"
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+
+	"maunium.net/go/mautrix/id"
+)
+
+var _ Store = (*database.Database)(nil)
+
+// Store persists rooms, ghosts and users so that bridgekit can serve them without the connector.
+// If no Store is set on the BridgeKit before Init, the default database.Database is used.
+type Store interface {
+	matrix.GhostStore
+
+	// GetRoomByMXID returns the room with the given Matrix room ID, or nil if it doesn't exist.
+	GetRoomByMXID(ctx context.Context, roomID id.RoomID) (*matrix.Room, error)
+	// GetRoomByRemoteID returns the room with the given remote ID, or nil if it doesn't exist.
+	GetRoomByRemoteID(ctx context.Context, remoteID string) (*matrix.Room, error)
+	// GetAllRooms returns all stored rooms.
+	GetAllRooms(ctx context.Context) ([]*matrix.Room, error)
+	// PutRoom inserts or updates the given room. Ghosts that aren't stored yet are added, stored ghosts are left untouched.
+	PutRoom(ctx context.Context, room *matrix.Room) error
+	// DeleteRoom removes the given room.
+	DeleteRoom(ctx context.Context, room *matrix.Room) error
+
+	// GetGhostByMXID returns the ghost with the given Matrix user ID, or nil if it doesn't exist.
+	GetGhostByMXID(ctx context.Context, userID id.UserID) (*matrix.Ghost, error)
+	// GetGhostByRemoteID returns the ghost with the given remote ID, or nil if it doesn't exist.
+	GetGhostByRemoteID(ctx context.Context, remoteID string) (*matrix.Ghost, error)
+
+	// GetUserByMXID returns the user with the given Matrix user ID, or nil if it doesn't exist.
+	GetUserByMXID(ctx context.Context, userID id.UserID) (*matrix.User, error)
+	// GetAllUserIDs returns the Matrix user IDs of all stored users.
+	GetAllUserIDs(ctx context.Context) ([]id.UserID, error)
+
+	// GetMessageByEventID returns the bridged message for the given Matrix event, or nil if it doesn't exist.
+	GetMessageByEventID(ctx context.Context, eventID id.EventID) (*matrix.BridgedMessage, error)
+	// GetMessageByRemoteID returns the given part of a remote message in a room, or nil if it doesn't exist.
+	GetMessageByRemoteID(ctx context.Context, roomID id.RoomID, remoteID string, partIndex int) (*matrix.BridgedMessage, error)
+	// GetMessagePartsByRemoteID returns all parts of a remote message in a room, ordered by part index.
+	GetMessagePartsByRemoteID(ctx context.Context, roomID id.RoomID, remoteID string) ([]*matrix.BridgedMessage, error)
+	// PutMessage inserts or updates the given message mapping.
+	PutMessage(ctx context.Context, msg *matrix.BridgedMessage) error
+	// DeleteMessage removes the given message mapping.
+	DeleteMessage(ctx context.Context, msg *matrix.BridgedMessage) error
+
+	// GetReaction returns the reaction of the sender with the given key on the target event, or nil if it doesn't exist.
+	GetReaction(ctx context.Context, target id.EventID, sender id.UserID, key string) (*matrix.Reaction, error)
+	// GetReactionByEventID returns the reaction with the given Matrix event ID, or nil if it doesn't exist.
+	GetReactionByEventID(ctx context.Context, eventID id.EventID) (*matrix.Reaction, error)
+	// PutReaction inserts or updates the given reaction.
+	PutReaction(ctx context.Context, reaction *matrix.Reaction) error
+	// DeleteReaction removes the given reaction.
+	DeleteReaction(ctx context.Context, reaction *matrix.Reaction) error
+}
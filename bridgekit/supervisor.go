@@ -0,0 +1,185 @@
+package bridgekit
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge/status"
+)
+
+// ErrBadCredentials is returned by UserConnector.Connect if the remote network rejected the credentials of the user.
+// Sessions failing with this error aren't retried, and the user is marked as having bad credentials.
+var ErrBadCredentials = errors.New("bad credentials")
+
+// ConnectError attaches a bridge state error code to an error returned by UserConnector.Connect.
+type ConnectError struct {
+	Code status.BridgeStateErrorCode
+	Err  error
+}
+
+func (e *ConnectError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// ReconnectConfig controls how the sessions of UserConnector are retried.
+// Zero values are replaced with the defaults.
+type ReconnectConfig struct {
+	// InitialDelay is the delay before the first retry. Defaults to 2 seconds.
+	InitialDelay time.Duration
+	// MaxDelay caps the exponentially growing delay. Defaults to 5 minutes.
+	MaxDelay time.Duration
+	// MaxRetries is the number of retries in a row before giving up. Defaults to retrying forever.
+	MaxRetries int
+	// Jitter randomises each delay by up to this fraction of it. Defaults to 0.2.
+	Jitter float64
+}
+
+// delay returns the backoff delay before the given retry, counting from 1.
+func (rc ReconnectConfig) delay(retry int) time.Duration {
+	initialDelay, maxDelay, jitter := rc.InitialDelay, rc.MaxDelay, rc.Jitter
+	if initialDelay <= 0 {
+		initialDelay = 2 * time.Second
+	}
+	if maxDelay <= 0 {
+		maxDelay = 5 * time.Minute
+	}
+	if jitter <= 0 {
+		jitter = 0.2
+	}
+
+	delay := initialDelay
+	for i := 1; i < retry && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxDelay)
+
+	return delay + time.Duration((rand.Float64()*2-1)*jitter*float64(delay))
+}
+
+type userSession struct {
+	user   *matrix.User
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// ConnectUser starts the remote session of the user through UserConnector, unless it's already running.
+func (m *BridgeKit[T]) ConnectUser(user *matrix.User) {
+	connector, ok := m.Connector.(UserConnector)
+	if !ok {
+		return
+	}
+
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+	if _, ok := m.sessions[user.MXID]; ok {
+		return
+	}
+
+	log := m.log.With().Str("action", "user session").Stringer("user_id", user.MXID).Logger()
+	ctx, cancel := context.WithCancel(log.WithContext(m.parentCtx))
+	session := &userSession{user: user, cancel: cancel, done: make(chan struct{})}
+	m.sessions[user.MXID] = session
+
+	go m.superviseUser(ctx, connector, user, session)
+}
+
+// DisconnectUser ends the remote session of the user and waits for it to stop.
+func (m *BridgeKit[T]) DisconnectUser(user *matrix.User) {
+	m.sessionsLock.Lock()
+	session, ok := m.sessions[user.MXID]
+	m.sessionsLock.Unlock()
+	if !ok {
+		return
+	}
+
+	session.cancel()
+	m.Connector.(UserConnector).Disconnect(user)
+	<-session.done
+}
+
+// connectLoggedInUsers connects every stored user that is logged in to the remote network.
+func (m *BridgeKit[T]) connectLoggedInUsers(ctx context.Context) {
+	userIDs, err := m.Store.GetAllUserIDs(ctx)
+	if err != nil {
+		m.log.Err(err).Msg("Failed to get users to connect")
+		return
+	}
+
+	for _, userID := range userIDs {
+		if user := m.GetUser(ctx, userID, false); user != nil && m.hasRemoteLogin(ctx, user) {
+			m.ConnectUser(user)
+		}
+	}
+}
+
+func (m *BridgeKit[T]) superviseUser(ctx context.Context, connector UserConnector, user *matrix.User, session *userSession) {
+	log := zerolog.Ctx(ctx)
+	defer func() {
+		m.sessionsLock.Lock()
+		if m.sessions[user.MXID] == session {
+			delete(m.sessions, user.MXID)
+		}
+		m.sessionsLock.Unlock()
+		close(session.done)
+	}()
+
+	retries := 0
+	for {
+		m.ReportConnecting(user)
+		var wasConnected atomic.Bool
+		err := connector.Connect(ctx, user, func() {
+			wasConnected.Store(true)
+			m.ReportConnected(user)
+		})
+		if ctx.Err() != nil {
+			return
+		} else if err == nil {
+			log.Debug().Msg("Remote session ended")
+			return
+		}
+
+		var code status.BridgeStateErrorCode
+		var connectErr *ConnectError
+		if errors.As(err, &connectErr) {
+			code = connectErr.Code
+		}
+
+		if errors.Is(err, ErrBadCredentials) {
+			log.Warn().Err(err).Msg("Remote session rejected the credentials")
+			if err := m.setUserLoginState(ctx, user, matrix.LoginStateBadCredentials, code, err.Error()); err != nil {
+				log.Err(err).Msg("Failed to save login state")
+			}
+			return
+		}
+
+		if wasConnected.Load() {
+			retries = 0
+		}
+		retries++
+		if m.Reconnect.MaxRetries > 0 && retries > m.Reconnect.MaxRetries {
+			log.Err(err).Int("retries", retries-1).Msg("Giving up reconnecting remote session")
+			m.ReportUnknownError(user, code, err.Error())
+			return
+		}
+
+		delay := m.Reconnect.delay(retries)
+		log.Warn().Err(err).Int("retry", retries).Dur("delay", delay).Msg("Remote session failed, reconnecting")
+		m.ReportTransientDisconnect(user, code, err.Error())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package bridgekit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestReconnectConfigDelay(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ReconnectConfig
+		retry  int
+		want   time.Duration
+	}{
+		{"first retry", ReconnectConfig{}, 1, 2 * time.Second},
+		{"doubles", ReconnectConfig{}, 3, 8 * time.Second},
+		{"capped", ReconnectConfig{}, 20, 5 * time.Minute},
+		{"huge retry doesn't overflow", ReconnectConfig{}, 1000, 5 * time.Minute},
+		{"custom", ReconnectConfig{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second}, 3, 400 * time.Millisecond},
+		{"custom cap", ReconnectConfig{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second}, 5, time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jitter := tt.config.Jitter
+			if jitter <= 0 {
+				jitter = 0.2
+			}
+			low := tt.want - time.Duration(jitter*float64(tt.want))
+			high := tt.want + time.Duration(jitter*float64(tt.want))
+
+			for i := 0; i < 100; i++ {
+				if got := tt.config.delay(tt.retry); got < low || got > high {
+					t.Fatalf("expected delay between %s and %s, got %s", low, high, got)
+				}
+			}
+		})
+	}
+}
+
+// testUserConnector fails every other session right after connecting, and keeps the others open until they're cancelled.
+type testUserConnector struct {
+	testConnector
+
+	connects atomic.Int64
+	// loggedIn is used by IsUserLoggedIn if it's set
+	loggedIn map[id.UserID]bool
+}
+
+func (c *testUserConnector) Connect(ctx context.Context, user *matrix.User, connected func()) error {
+	connected()
+	if c.connects.Add(1)%2 == 1 {
+		return errors.New("connection reset")
+	}
+
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (c *testUserConnector) Disconnect(user *matrix.User) {}
+
+type testLoginCheckConnector struct {
+	testUserConnector
+}
+
+func (c *testLoginCheckConnector) IsUserLoggedIn(ctx context.Context, user *matrix.User) bool {
+	return c.loggedIn[user.MXID]
+}
+
+// testBadCredentialsConnector rejects the credentials of every session.
+type testBadCredentialsConnector struct {
+	testUserConnector
+}
+
+func (c *testBadCredentialsConnector) Connect(ctx context.Context, user *matrix.User, connected func()) error {
+	return &ConnectError{Code: "test-expired", Err: fmt.Errorf("session expired: %w", ErrBadCredentials)}
+}
+
+func TestConnectUserBadCredentials(t *testing.T) {
+	user := &matrix.User{MXID: "@user:example.com", LoginState: matrix.LoginStateLoggedIn}
+	m := newTestBridgeKit(t, &testBadCredentialsConnector{}, user)
+
+	m.ConnectUser(user)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if m.GetUserBridgeState(user).StateEvent == status.StateBadCredentials {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("expected bad credentials to be reported, got %q", m.GetUserBridgeState(user).StateEvent)
+		}
+	}
+
+	if state := m.GetUserBridgeState(user); state.Error != "test-expired" {
+		t.Errorf("expected the error code of the connector, got %q", state.Error)
+	}
+
+	store := m.Store.(*testStore)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.puts[user.MXID] != matrix.LoginStateBadCredentials {
+		t.Errorf("expected the login state to be saved, got %q", store.puts[user.MXID])
+	}
+}
+
+func TestConnectLoggedInUsers(t *testing.T) {
+	users := []*matrix.User{
+		{MXID: "@in:example.com", LoginState: matrix.LoginStateLoggedIn},
+		{MXID: "@out:example.com", LoginState: matrix.LoginStateLoggedOut},
+		{MXID: "@never:example.com", LoginState: matrix.LoginStateUnknown},
+		{MXID: "@bad:example.com", LoginState: matrix.LoginStateBadCredentials},
+	}
+
+	tests := []struct {
+		name      string
+		connector UserConnector
+		want      []id.UserID
+	}{
+		{"login state", &testUserConnector{}, []id.UserID{"@in:example.com"}},
+		{
+			"login checker",
+			&testLoginCheckConnector{testUserConnector{loggedIn: map[id.UserID]bool{"@never:example.com": true}}},
+			[]id.UserID{"@never:example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestBridgeKit(t, tt.connector.(BridgeConnector), users...)
+			m.Reconnect = ReconnectConfig{InitialDelay: time.Millisecond}
+			for _, user := range users {
+				m.Store.(*testStore).userIDs = append(m.Store.(*testStore).userIDs, user.MXID)
+			}
+
+			m.connectLoggedInUsers(context.Background())
+
+			m.sessionsLock.Lock()
+			got := len(m.sessions)
+			for _, userID := range tt.want {
+				if _, ok := m.sessions[userID]; !ok {
+					t.Errorf("expected %s to be connected", userID)
+				}
+			}
+			m.sessionsLock.Unlock()
+			if got != len(tt.want) {
+				t.Errorf("expected %d sessions, got %d", len(tt.want), got)
+			}
+
+			for _, user := range users {
+				m.DisconnectUser(user)
+			}
+		})
+	}
+}
+
+// TestSupervisorRace connects and disconnects users concurrently while their sessions fail and reconnect.
+// It is meant to be run with -race.
+func TestSupervisorRace(t *testing.T) {
+	users := []*matrix.User{
+		{MXID: "@a:example.com", LoginState: matrix.LoginStateLoggedIn},
+		{MXID: "@b:example.com", LoginState: matrix.LoginStateLoggedIn},
+		{MXID: "@c:example.com", LoginState: matrix.LoginStateLoggedIn},
+	}
+	connector := &testUserConnector{}
+	m := newTestBridgeKit(t, connector, users...)
+	m.Reconnect = ReconnectConfig{InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	var wg sync.WaitGroup
+	for _, user := range users {
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					m.ConnectUser(user)
+					_ = m.GetUserBridgeState(user)
+					if j%5 == 4 {
+						m.DisconnectUser(user)
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	for _, user := range users {
+		m.DisconnectUser(user)
+	}
+
+	m.sessionsLock.Lock()
+	remaining := len(m.sessions)
+	m.sessionsLock.Unlock()
+	if remaining != 0 {
+		t.Fatalf("expected all sessions to be stopped, %d are left", remaining)
+	}
+	if connector.connects.Load() == 0 {
+		t.Fatal("expected sessions to connect")
+	}
+	for _, user := range users {
+		if state := m.GetUserBridgeState(user).StateEvent; state == "" || state == status.StateUnknownError {
+			t.Errorf("unexpected state %q for %s", state, user.MXID)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package database
+
+import (
+	"errors"
+
+	"go.mau.fi/util/dbutil"
+
+	"github.com/dvcrn/matrix-bridgekit/database/upgrades"
+)
+
+// ErrNoRemoteID is returned when trying to store a room that has no remote ID set.
+var ErrNoRemoteID = errors.New("room has no remote id")
+
+// Database is the default SQLite/Postgres backed store for rooms, ghosts and users.
+type Database struct {
+	*dbutil.Database
+}
+
+// New wraps the given database and registers the bridgekit schema upgrades on it.
+// The upgrades are executed by the bridge when it starts.
+func New(db *dbutil.Database) *Database {
+	db.UpgradeTable = upgrades.Table
+	return &Database{
+		Database: db,
+	}
+}
@@ -0,0 +1,35 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"go.mau.fi/util/dbutil"
+)
+
+// newTestDatabase returns an upgraded in-memory SQLite database.
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+
+	rawDB, err := sql.Open("sqlite3", ":memory:?_foreign_keys=on")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	// every connection to :memory: gets its own database
+	rawDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = rawDB.Close() })
+
+	db, err := dbutil.NewWithDB(rawDB, "sqlite3")
+	if err != nil {
+		t.Fatalf("failed to wrap database: %v", err)
+	}
+
+	store := New(db)
+	if err := store.Upgrade(context.Background()); err != nil {
+		t.Fatalf("failed to upgrade database: %v", err)
+	}
+
+	return store
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+)
+
+const (
+	ghostColumns            = `mxid, remote_id, display_name, user_name, avatar_url, custom_mxid, access_token, name_set, avatar_source, avatar_hash, profile_synced_at`
+	getGhostBaseQuery       = `SELECT ` + ghostColumns + ` FROM ghost `
+	getGhostByMXIDQuery     = getGhostBaseQuery + `WHERE mxid=$1`
+	getGhostByRemoteIDQuery = getGhostBaseQuery + `WHERE remote_id=$1`
+	upsertGhostQuery        = `
+		INSERT INTO ghost (mxid, remote_id, display_name, user_name, avatar_url, custom_mxid, access_token, name_set, avatar_source, avatar_hash, profile_synced_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (mxid) DO UPDATE
+			SET remote_id=excluded.remote_id, display_name=excluded.display_name,
+			    user_name=excluded.user_name, avatar_url=excluded.avatar_url,
+			    custom_mxid=excluded.custom_mxid, access_token=excluded.access_token,
+			    name_set=excluded.name_set, avatar_source=excluded.avatar_source,
+			    avatar_hash=excluded.avatar_hash, profile_synced_at=excluded.profile_synced_at
+	`
+	insertMissingGhostQuery = `
+		INSERT INTO ghost (mxid, remote_id, display_name, user_name, avatar_url, custom_mxid, access_token, name_set, avatar_source, avatar_hash, profile_synced_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (mxid) DO NOTHING
+	`
+)
+
+// GetGhostByMXID returns the ghost with the given Matrix user ID, or nil if it's not stored.
+func (db *Database) GetGhostByMXID(ctx context.Context, userID id.UserID) (*matrix.Ghost, error) {
+	return getGhost(db.QueryRow(ctx, getGhostByMXIDQuery, userID))
+}
+
+// GetGhostByRemoteID returns the ghost with the given remote ID, or nil if it's not stored.
+func (db *Database) GetGhostByRemoteID(ctx context.Context, remoteID string) (*matrix.Ghost, error) {
+	return getGhost(db.QueryRow(ctx, getGhostByRemoteIDQuery, remoteID))
+}
+
+// PutGhost inserts the ghost, or updates it if it already exists.
+func (db *Database) PutGhost(ctx context.Context, ghost *matrix.Ghost) error {
+	_, err := db.Exec(ctx, upsertGhostQuery, ghostArgs(ghost)...)
+	return err
+}
+
+// insertMissingGhost inserts the ghost if it isn't stored yet. Stored ghosts are left untouched.
+func (db *Database) insertMissingGhost(ctx context.Context, ghost *matrix.Ghost) error {
+	_, err := db.Exec(ctx, insertMissingGhostQuery, ghostArgs(ghost)...)
+	return err
+}
+
+func ghostArgs(ghost *matrix.Ghost) []any {
+	return []any{
+		ghost.MXID, ghost.RemoteID, ghost.DisplayName, ghost.UserName, ghost.AvatarURL.String(),
+		dbutil.StrPtr(ghost.GetCustomMXID()), ghost.GetAccessToken(), ghost.NameSet, ghost.AvatarSource, ghost.AvatarHash, ghost.ProfileSyncedAt,
+	}
+}
+
+func getGhost(row dbutil.Scannable) (*matrix.Ghost, error) {
+	ghost, err := scanGhost(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return ghost, err
+}
+
+// scanGhost scans the ghost columns, followed by the given extra columns.
+func scanGhost(row dbutil.Scannable, extra ...any) (*matrix.Ghost, error) {
+	var ghost matrix.Ghost
+	var customMXID sql.NullString
+	dest := []any{&ghost.MXID, &ghost.RemoteID, &ghost.DisplayName, &ghost.UserName, &ghost.AvatarURL, &customMXID, &ghost.AccessToken,
+		&ghost.NameSet, &ghost.AvatarSource, &ghost.AvatarHash, &ghost.ProfileSyncedAt}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	ghost.CustomMXID = id.UserID(customMXID.String)
+
+	return &ghost, nil
+}
@@ -0,0 +1,89 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+)
+
+const (
+	getMessageBaseQuery = `
+		SELECT room_id, remote_id, part_index, event_id, sender_mxid, timestamp FROM message
+	`
+	getMessageByEventIDQuery       = getMessageBaseQuery + `WHERE event_id=$1`
+	getMessageByRemoteIDQuery      = getMessageBaseQuery + `WHERE room_id=$1 AND remote_id=$2 AND part_index=$3`
+	getMessagePartsByRemoteIDQuery = getMessageBaseQuery + `WHERE room_id=$1 AND remote_id=$2 ORDER BY part_index`
+	upsertMessageQuery             = `
+		INSERT INTO message (room_id, remote_id, part_index, event_id, sender_mxid, timestamp)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (room_id, remote_id, part_index) DO UPDATE
+			SET event_id=excluded.event_id, sender_mxid=excluded.sender_mxid, timestamp=excluded.timestamp
+	`
+	deleteMessageQuery = `DELETE FROM message WHERE event_id=$1`
+)
+
+// GetMessageByEventID returns the bridged message for the given Matrix event, or nil if it's not stored.
+func (db *Database) GetMessageByEventID(ctx context.Context, eventID id.EventID) (*matrix.BridgedMessage, error) {
+	return getMessage(db.QueryRow(ctx, getMessageByEventIDQuery, eventID))
+}
+
+// GetMessageByRemoteID returns the given part of a remote message in a room, or nil if it's not stored.
+func (db *Database) GetMessageByRemoteID(ctx context.Context, roomID id.RoomID, remoteID string, partIndex int) (*matrix.BridgedMessage, error) {
+	return getMessage(db.QueryRow(ctx, getMessageByRemoteIDQuery, roomID, remoteID, partIndex))
+}
+
+// GetMessagePartsByRemoteID returns all parts of a remote message in a room, ordered by part index.
+func (db *Database) GetMessagePartsByRemoteID(ctx context.Context, roomID id.RoomID, remoteID string) ([]*matrix.BridgedMessage, error) {
+	rows, err := db.Query(ctx, getMessagePartsByRemoteIDQuery, roomID, remoteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*matrix.BridgedMessage{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, rows.Err()
+}
+
+// PutMessage inserts the message mapping, or updates it if the message part already exists.
+func (db *Database) PutMessage(ctx context.Context, msg *matrix.BridgedMessage) error {
+	_, err := db.Exec(ctx, upsertMessageQuery, msg.RoomID, msg.RemoteID, msg.PartIndex, msg.EventID, msg.SenderMXID, msg.Timestamp)
+	return err
+}
+
+// DeleteMessage removes the mapping of the given message part.
+func (db *Database) DeleteMessage(ctx context.Context, msg *matrix.BridgedMessage) error {
+	_, err := db.Exec(ctx, deleteMessageQuery, msg.EventID)
+	return err
+}
+
+func getMessage(row dbutil.Scannable) (*matrix.BridgedMessage, error) {
+	msg, err := scanMessage(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return msg, err
+}
+
+func scanMessage(row dbutil.Scannable) (*matrix.BridgedMessage, error) {
+	var msg matrix.BridgedMessage
+	err := row.Scan(&msg.RoomID, &msg.RemoteID, &msg.PartIndex, &msg.EventID, &msg.SenderMXID, &msg.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+)
+
+func TestMessageQueries(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+
+	parts := []*matrix.BridgedMessage{
+		{RoomID: "!room:example.com", RemoteID: "msg1", PartIndex: 1, EventID: "$part1", SenderMXID: "@ghost:example.com", Timestamp: 2},
+		{RoomID: "!room:example.com", RemoteID: "msg1", PartIndex: 0, EventID: "$part0", SenderMXID: "@ghost:example.com", Timestamp: 1},
+		{RoomID: "!other:example.com", RemoteID: "msg1", PartIndex: 0, EventID: "$other", SenderMXID: "@ghost:example.com", Timestamp: 3},
+	}
+	for _, part := range parts {
+		if err := db.PutMessage(ctx, part); err != nil {
+			t.Fatalf("failed to put message: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		get       func() (*matrix.BridgedMessage, error)
+		wantEvent string
+	}{
+		{"by event ID", func() (*matrix.BridgedMessage, error) { return db.GetMessageByEventID(ctx, "$part1") }, "$part1"},
+		{"by remote ID", func() (*matrix.BridgedMessage, error) {
+			return db.GetMessageByRemoteID(ctx, "!room:example.com", "msg1", 0)
+		}, "$part0"},
+		{"by remote ID in other room", func() (*matrix.BridgedMessage, error) {
+			return db.GetMessageByRemoteID(ctx, "!other:example.com", "msg1", 0)
+		}, "$other"},
+		{"unknown event ID", func() (*matrix.BridgedMessage, error) { return db.GetMessageByEventID(ctx, "$unknown") }, ""},
+		{"unknown part", func() (*matrix.BridgedMessage, error) {
+			return db.GetMessageByRemoteID(ctx, "!room:example.com", "msg1", 2)
+		}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := tt.get()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tt.wantEvent == "" {
+				if msg != nil {
+					t.Fatalf("expected no message, got %+v", msg)
+				}
+				return
+			}
+
+			if msg == nil || string(msg.EventID) != tt.wantEvent {
+				t.Fatalf("expected event %s, got %+v", tt.wantEvent, msg)
+			}
+		})
+	}
+
+	t.Run("parts are ordered by index", func(t *testing.T) {
+		got, err := db.GetMessagePartsByRemoteID(ctx, "!room:example.com", "msg1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(got) != 2 || got[0].EventID != "$part0" || got[1].EventID != "$part1" {
+			t.Fatalf("unexpected parts %+v", got)
+		}
+	})
+
+	t.Run("put updates existing parts", func(t *testing.T) {
+		edited := *parts[1]
+		edited.EventID = "$edited"
+		if err := db.PutMessage(ctx, &edited); err != nil {
+			t.Fatalf("failed to put message: %v", err)
+		}
+
+		msg, err := db.GetMessageByRemoteID(ctx, "!room:example.com", "msg1", 0)
+		if err != nil || msg == nil || msg.EventID != "$edited" {
+			t.Fatalf("expected updated message, got %+v, %v", msg, err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := db.DeleteMessage(ctx, parts[0]); err != nil {
+			t.Fatalf("failed to delete message: %v", err)
+		}
+
+		msg, err := db.GetMessageByEventID(ctx, "$part1")
+		if err != nil || msg != nil {
+			t.Fatalf("expected deleted message, got %+v, %v", msg, err)
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+)
+
+const (
+	getReactionBaseQuery = `
+		SELECT room_id, target_event_id, sender_mxid, emoji, event_id FROM reaction
+	`
+	getReactionQuery          = getReactionBaseQuery + `WHERE target_event_id=$1 AND sender_mxid=$2 AND emoji=$3`
+	getReactionByEventIDQuery = getReactionBaseQuery + `WHERE event_id=$1`
+	insertReactionQuery       = `
+		INSERT INTO reaction (room_id, target_event_id, sender_mxid, emoji, event_id)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (target_event_id, sender_mxid, emoji) DO UPDATE SET event_id=excluded.event_id
+	`
+	deleteReactionQuery = `DELETE FROM reaction WHERE event_id=$1`
+)
+
+// GetReaction returns the reaction of the sender with the given key on the target event, or nil if it's not stored.
+func (db *Database) GetReaction(ctx context.Context, target id.EventID, sender id.UserID, key string) (*matrix.Reaction, error) {
+	return getReaction(db.QueryRow(ctx, getReactionQuery, target, sender, key))
+}
+
+// GetReactionByEventID returns the reaction with the given Matrix event ID, or nil if it's not stored.
+func (db *Database) GetReactionByEventID(ctx context.Context, eventID id.EventID) (*matrix.Reaction, error) {
+	return getReaction(db.QueryRow(ctx, getReactionByEventIDQuery, eventID))
+}
+
+// PutReaction inserts the reaction, or updates its event ID if it already exists.
+func (db *Database) PutReaction(ctx context.Context, reaction *matrix.Reaction) error {
+	_, err := db.Exec(ctx, insertReactionQuery, reaction.RoomID, reaction.TargetEventID, reaction.SenderMXID, reaction.Key, reaction.EventID)
+	return err
+}
+
+// DeleteReaction removes the given reaction.
+func (db *Database) DeleteReaction(ctx context.Context, reaction *matrix.Reaction) error {
+	_, err := db.Exec(ctx, deleteReactionQuery, reaction.EventID)
+	return err
+}
+
+func getReaction(row dbutil.Scannable) (*matrix.Reaction, error) {
+	var reaction matrix.Reaction
+	err := row.Scan(&reaction.RoomID, &reaction.TargetEventID, &reaction.SenderMXID, &reaction.Key, &reaction.EventID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &reaction, nil
+}
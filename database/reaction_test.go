@@ -0,0 +1,83 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+)
+
+func TestReactionQueries(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+
+	reaction := &matrix.Reaction{
+		RoomID:        "!room:example.com",
+		TargetEventID: "$target",
+		SenderMXID:    "@ghost:example.com",
+		Key:           "👍",
+		EventID:       "$reaction",
+	}
+	if err := db.PutReaction(ctx, reaction); err != nil {
+		t.Fatalf("failed to put reaction: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		target    id.EventID
+		sender    id.UserID
+		key       string
+		wantEvent string
+	}{
+		{"same reaction", "$target", "@ghost:example.com", "👍", "$reaction"},
+		{"other key", "$target", "@ghost:example.com", "❤️", ""},
+		{"other sender", "$target", "@other:example.com", "👍", ""},
+		{"other target", "$other", "@ghost:example.com", "👍", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.GetReaction(ctx, tt.target, tt.sender, tt.key)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tt.wantEvent == "" {
+				if got != nil {
+					t.Fatalf("expected no reaction, got %+v", got)
+				}
+			} else if got == nil || string(got.EventID) != tt.wantEvent {
+				t.Fatalf("expected reaction %s, got %+v", tt.wantEvent, got)
+			}
+		})
+	}
+
+	t.Run("put replaces the event of a duplicate", func(t *testing.T) {
+		dup := *reaction
+		dup.EventID = "$reaction2"
+		if err := db.PutReaction(ctx, &dup); err != nil {
+			t.Fatalf("failed to put reaction: %v", err)
+		}
+
+		got, err := db.GetReactionByEventID(ctx, "$reaction2")
+		if err != nil || got == nil || got.Key != reaction.Key {
+			t.Fatalf("expected replaced reaction, got %+v, %v", got, err)
+		}
+		if got, _ := db.GetReactionByEventID(ctx, "$reaction"); got != nil {
+			t.Fatalf("expected old event to be gone, got %+v", got)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := db.DeleteReaction(ctx, &matrix.Reaction{EventID: "$reaction2"}); err != nil {
+			t.Fatalf("failed to delete reaction: %v", err)
+		}
+
+		got, err := db.GetReaction(ctx, reaction.TargetEventID, reaction.SenderMXID, reaction.Key)
+		if err != nil || got != nil {
+			t.Fatalf("expected deleted reaction, got %+v, %v", got, err)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+)
+
+const (
+	getRoomBaseQuery = `
+		SELECT remote_id, mxid, name, topic, encrypted, private_chat FROM room
+	`
+	getRoomByMXIDQuery     = getRoomBaseQuery + `WHERE mxid=$1`
+	getRoomByRemoteIDQuery = getRoomBaseQuery + `WHERE remote_id=$1`
+	upsertRoomQuery        = `
+		INSERT INTO room (remote_id, mxid, name, topic, encrypted, private_chat)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (remote_id) DO UPDATE
+			SET mxid=excluded.mxid, name=excluded.name, topic=excluded.topic,
+			    encrypted=excluded.encrypted, private_chat=excluded.private_chat
+	`
+	deleteRoomQuery    = `DELETE FROM room WHERE remote_id=$1`
+	getRoomGhostsQuery = `
+		SELECT ` + ghostColumns + `, room_ghost.role
+		FROM room_ghost
+		INNER JOIN ghost ON ghost.mxid = room_ghost.ghost_mxid
+		WHERE room_ghost.room_remote_id=$1
+		ORDER BY room_ghost.position
+	`
+	deleteRoomGhostsQuery = `DELETE FROM room_ghost WHERE room_remote_id=$1`
+	insertRoomGhostQuery  = `INSERT INTO room_ghost (room_remote_id, ghost_mxid, position, role) VALUES ($1, $2, $3, $4)`
+)
+
+// GetRoomByMXID returns the room with the given Matrix room ID, or nil if it's not stored.
+func (db *Database) GetRoomByMXID(ctx context.Context, roomID id.RoomID) (*matrix.Room, error) {
+	return db.loadRoom(ctx, db.QueryRow(ctx, getRoomByMXIDQuery, roomID))
+}
+
+// GetRoomByRemoteID returns the room with the given remote ID, or nil if it's not stored.
+func (db *Database) GetRoomByRemoteID(ctx context.Context, remoteID string) (*matrix.Room, error) {
+	return db.loadRoom(ctx, db.QueryRow(ctx, getRoomByRemoteIDQuery, remoteID))
+}
+
+// GetAllRooms returns all stored rooms.
+func (db *Database) GetAllRooms(ctx context.Context) ([]*matrix.Room, error) {
+	rows, err := db.Query(ctx, getRoomBaseQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := []*matrix.Room{}
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, room := range rooms {
+		if err = db.loadRoomGhosts(ctx, room); err != nil {
+			return nil, err
+		}
+	}
+
+	return rooms, nil
+}
+
+// PutRoom inserts the room together with its ghosts, or updates it if it already exists.
+// Ghosts that are already stored are only linked to the room, use PutGhost to update them.
+func (db *Database) PutRoom(ctx context.Context, room *matrix.Room) error {
+	if room.RemotedID == "" {
+		return ErrNoRemoteID
+	}
+
+	return db.DoTxn(ctx, nil, func(ctx context.Context) error {
+		_, err := db.Exec(ctx, upsertRoomQuery,
+			room.RemotedID, dbutil.StrPtr(room.MXID), room.Name, room.Topic, room.Encrypted, room.PrivateChat,
+		)
+		if err != nil {
+			return err
+		}
+
+		if _, err = db.Exec(ctx, deleteRoomGhostsQuery, room.RemotedID); err != nil {
+			return err
+		}
+		for i, ghost := range room.Ghosts {
+			// ghosts built by the connector don't have the stored profile and double puppet state, so only add new ones
+			if err = db.insertMissingGhost(ctx, ghost); err != nil {
+				return err
+			}
+			if _, err = db.Exec(ctx, insertRoomGhostQuery, room.RemotedID, ghost.MXID, i, room.GhostRole(ghost.MXID)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// DeleteRoom removes the room from the database.
+func (db *Database) DeleteRoom(ctx context.Context, room *matrix.Room) error {
+	_, err := db.Exec(ctx, deleteRoomQuery, room.RemotedID)
+	return err
+}
+
+func (db *Database) loadRoom(ctx context.Context, row *sql.Row) (*matrix.Room, error) {
+	room, err := scanRoom(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = db.loadRoomGhosts(ctx, room); err != nil {
+		return nil, err
+	}
+
+	return room, nil
+}
+
+// loadRoomGhosts fills in the ghosts of the room and their roles.
+func (db *Database) loadRoomGhosts(ctx context.Context, room *matrix.Room) error {
+	rows, err := db.Query(ctx, getRoomGhostsQuery, room.RemotedID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	room.Ghosts = []*matrix.Ghost{}
+	room.GhostRoles = nil
+	for rows.Next() {
+		var role matrix.GhostRole
+		ghost, err := scanGhost(rows, &role)
+		if err != nil {
+			return err
+		}
+		room.Ghosts = append(room.Ghosts, ghost)
+		room.SetGhostRole(ghost.MXID, role)
+	}
+
+	return rows.Err()
+}
+
+func scanRoom(row dbutil.Scannable) (*matrix.Room, error) {
+	var room matrix.Room
+	var mxid sql.NullString
+	err := row.Scan(&room.RemotedID, &mxid, &room.Name, &room.Topic, &room.Encrypted, &room.PrivateChat)
+	if err != nil {
+		return nil, err
+	}
+
+	room.MXID = id.RoomID(mxid.String)
+	return &room, nil
+}
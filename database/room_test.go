@@ -0,0 +1,190 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+)
+
+func TestRoomQueries(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+
+	ghosts := []*matrix.Ghost{
+		{MXID: "@test_b:example.com", RemoteID: "b", DisplayName: "B", UserName: "b"},
+		{MXID: "@test_a:example.com", RemoteID: "a", DisplayName: "A", UserName: "a"},
+	}
+	room := &matrix.Room{RemotedID: "remote", MXID: "!room:example.com", Name: "Room", Topic: "Topic", Ghosts: ghosts}
+	if err := db.PutRoom(ctx, room); err != nil {
+		t.Fatalf("failed to put room: %v", err)
+	}
+	unbridged := &matrix.Room{RemotedID: "unbridged", Name: "Unbridged"}
+	if err := db.PutRoom(ctx, unbridged); err != nil {
+		t.Fatalf("failed to put room: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		get        func() (*matrix.Room, error)
+		wantRemote string
+		wantGhosts int
+	}{
+		{"by MXID", func() (*matrix.Room, error) { return db.GetRoomByMXID(ctx, "!room:example.com") }, "remote", 2},
+		{"by remote ID", func() (*matrix.Room, error) { return db.GetRoomByRemoteID(ctx, "remote") }, "remote", 2},
+		{"without MXID", func() (*matrix.Room, error) { return db.GetRoomByRemoteID(ctx, "unbridged") }, "unbridged", 0},
+		{"unknown MXID", func() (*matrix.Room, error) { return db.GetRoomByMXID(ctx, "!unknown:example.com") }, "", 0},
+		{"unknown remote ID", func() (*matrix.Room, error) { return db.GetRoomByRemoteID(ctx, "unknown") }, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.get()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tt.wantRemote == "" {
+				if got != nil {
+					t.Fatalf("expected no room, got %+v", got)
+				}
+				return
+			}
+
+			if got == nil || got.RemotedID != tt.wantRemote || len(got.Ghosts) != tt.wantGhosts {
+				t.Fatalf("expected room %s with %d ghosts, got %+v", tt.wantRemote, tt.wantGhosts, got)
+			}
+		})
+	}
+
+	t.Run("ghosts keep their order", func(t *testing.T) {
+		got, err := db.GetRoomByRemoteID(ctx, "remote")
+		if err != nil || got == nil {
+			t.Fatalf("failed to get room: %+v, %v", got, err)
+		}
+		if got.Ghosts[0].MXID != ghosts[0].MXID || got.Ghosts[1].MXID != ghosts[1].MXID {
+			t.Fatalf("unexpected ghost order %s, %s", got.Ghosts[0].MXID, got.Ghosts[1].MXID)
+		}
+	})
+
+	t.Run("all rooms", func(t *testing.T) {
+		got, err := db.GetAllRooms(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(got) != 2 {
+			t.Fatalf("expected 2 rooms, got %d", len(got))
+		}
+	})
+
+	t.Run("put replaces ghosts", func(t *testing.T) {
+		room.Ghosts = ghosts[1:]
+		if err := db.PutRoom(ctx, room); err != nil {
+			t.Fatalf("failed to put room: %v", err)
+		}
+
+		got, err := db.GetRoomByRemoteID(ctx, "remote")
+		if err != nil || got == nil || len(got.Ghosts) != 1 || got.Ghosts[0].MXID != ghosts[1].MXID {
+			t.Fatalf("expected one remaining ghost, got %+v, %v", got, err)
+		}
+	})
+
+	t.Run("remote ID is required", func(t *testing.T) {
+		err := db.PutRoom(ctx, &matrix.Room{MXID: "!new:example.com"})
+		if !errors.Is(err, ErrNoRemoteID) {
+			t.Fatalf("expected ErrNoRemoteID, got %v", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := db.DeleteRoom(ctx, unbridged); err != nil {
+			t.Fatalf("failed to delete room: %v", err)
+		}
+
+		got, err := db.GetRoomByRemoteID(ctx, "unbridged")
+		if err != nil || got != nil {
+			t.Fatalf("expected deleted room, got %+v, %v", got, err)
+		}
+	})
+}
+
+func TestRoomGhostRoles(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+
+	room := &matrix.Room{RemotedID: "remote", Name: "Room", Ghosts: []*matrix.Ghost{
+		{MXID: "@test_admin:example.com", RemoteID: "admin"},
+		{MXID: "@test_mod:example.com", RemoteID: "mod"},
+		{MXID: "@test_member:example.com", RemoteID: "member"},
+	}}
+	room.SetGhostRole("@test_admin:example.com", matrix.GhostRoleAdmin)
+	room.SetGhostRole("@test_mod:example.com", matrix.GhostRoleModerator)
+	if err := db.PutRoom(ctx, room); err != nil {
+		t.Fatalf("failed to put room: %v", err)
+	}
+
+	got, err := db.GetRoomByRemoteID(ctx, "remote")
+	if err != nil || got == nil {
+		t.Fatalf("failed to get room: %+v, %v", got, err)
+	}
+
+	tests := []struct {
+		ghost string
+		want  matrix.GhostRole
+	}{
+		{"@test_admin:example.com", matrix.GhostRoleAdmin},
+		{"@test_mod:example.com", matrix.GhostRoleModerator},
+		{"@test_member:example.com", matrix.GhostRoleMember},
+		{"@test_unknown:example.com", matrix.GhostRoleMember},
+	}
+
+	for _, tt := range tests {
+		if role := got.GhostRole(id.UserID(tt.ghost)); role != tt.want {
+			t.Errorf("expected role %q for %s, got %q", tt.want, tt.ghost, role)
+		}
+	}
+}
+
+func TestPutRoomKeepsStoredGhosts(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+
+	stored := &matrix.Ghost{
+		MXID:        "@test_alice:example.com",
+		RemoteID:    "alice",
+		DisplayName: "Alice",
+		NameSet:     true,
+		AvatarHash:  "hash",
+		CustomMXID:  "@alice:example.com",
+		AccessToken: "token",
+	}
+	if err := db.PutGhost(ctx, stored); err != nil {
+		t.Fatalf("failed to put ghost: %v", err)
+	}
+
+	room := &matrix.Room{RemotedID: "remote", Name: "Room", Ghosts: []*matrix.Ghost{
+		{MXID: stored.MXID, RemoteID: stored.RemoteID},
+		{MXID: "@test_bob:example.com", RemoteID: "bob"},
+	}}
+	if err := db.PutRoom(ctx, room); err != nil {
+		t.Fatalf("failed to put room: %v", err)
+	}
+
+	got, err := db.GetGhostByMXID(ctx, stored.MXID)
+	if err != nil || got == nil {
+		t.Fatalf("failed to get ghost: %+v, %v", got, err)
+	}
+	if !got.NameSet || got.DisplayName != "Alice" || got.AvatarHash != "hash" {
+		t.Errorf("expected the profile state to be kept, got %+v", got)
+	}
+	if got.CustomMXID != "@alice:example.com" || got.AccessToken != "token" {
+		t.Errorf("expected the double puppet to be kept, got %s %q", got.CustomMXID, got.AccessToken)
+	}
+
+	if got, err := db.GetGhostByMXID(ctx, "@test_bob:example.com"); err != nil || got == nil {
+		t.Fatalf("expected the new ghost to be inserted, got %+v, %v", got, err)
+	}
+}
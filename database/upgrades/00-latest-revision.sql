@@ -0,0 +1,70 @@
+-- v0 -> v8: Latest revision
+
+CREATE TABLE room (
+	remote_id    TEXT    PRIMARY KEY,
+	mxid         TEXT    UNIQUE,
+	name         TEXT    NOT NULL,
+	topic        TEXT    NOT NULL,
+	encrypted    BOOLEAN NOT NULL DEFAULT false,
+	private_chat BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE TABLE ghost (
+	mxid              TEXT    PRIMARY KEY,
+	remote_id         TEXT    NOT NULL,
+	display_name      TEXT    NOT NULL,
+	user_name         TEXT    NOT NULL,
+	avatar_url        TEXT    NOT NULL,
+	custom_mxid       TEXT,
+	access_token      TEXT    NOT NULL DEFAULT '',
+	name_set          BOOLEAN NOT NULL DEFAULT false,
+	avatar_source     TEXT    NOT NULL DEFAULT '',
+	avatar_hash       TEXT    NOT NULL DEFAULT '',
+	profile_synced_at BIGINT  NOT NULL DEFAULT 0
+);
+
+CREATE TABLE room_ghost (
+	room_remote_id TEXT    NOT NULL,
+	ghost_mxid     TEXT    NOT NULL,
+	position       INTEGER NOT NULL,
+	role           TEXT    NOT NULL DEFAULT '',
+
+	PRIMARY KEY (room_remote_id, ghost_mxid),
+	CONSTRAINT room_ghost_room_fkey FOREIGN KEY (room_remote_id) REFERENCES room (remote_id)
+		ON DELETE CASCADE ON UPDATE CASCADE,
+	CONSTRAINT room_ghost_ghost_fkey FOREIGN KEY (ghost_mxid) REFERENCES ghost (mxid)
+		ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE "user" (
+	mxid               TEXT    PRIMARY KEY,
+	remote_id          TEXT    NOT NULL,
+	remote_name        TEXT    NOT NULL,
+	display_name       TEXT    NOT NULL,
+	permission_level   INTEGER NOT NULL,
+	management_room    TEXT,
+	access_token       TEXT    NOT NULL,
+	login_state        TEXT    NOT NULL DEFAULT '',
+	remote_credentials TEXT
+);
+
+CREATE TABLE message (
+	room_id     TEXT    NOT NULL,
+	remote_id   TEXT    NOT NULL,
+	part_index  INTEGER NOT NULL,
+	event_id    TEXT    NOT NULL UNIQUE,
+	sender_mxid TEXT    NOT NULL,
+	timestamp   BIGINT  NOT NULL,
+
+	PRIMARY KEY (room_id, remote_id, part_index)
+);
+
+CREATE TABLE reaction (
+	room_id         TEXT NOT NULL,
+	target_event_id TEXT NOT NULL,
+	sender_mxid     TEXT NOT NULL,
+	emoji           TEXT NOT NULL,
+	event_id        TEXT NOT NULL UNIQUE,
+
+	PRIMARY KEY (target_event_id, sender_mxid, emoji)
+);
@@ -0,0 +1,12 @@
+-- v2: Add message mapping table
+
+CREATE TABLE message (
+	room_id     TEXT    NOT NULL,
+	remote_id   TEXT    NOT NULL,
+	part_index  INTEGER NOT NULL,
+	event_id    TEXT    NOT NULL UNIQUE,
+	sender_mxid TEXT    NOT NULL,
+	timestamp   BIGINT  NOT NULL,
+
+	PRIMARY KEY (room_id, remote_id, part_index)
+);
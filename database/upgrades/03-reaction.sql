@@ -0,0 +1,11 @@
+-- v3: Add reaction table
+
+CREATE TABLE reaction (
+	room_id         TEXT NOT NULL,
+	target_event_id TEXT NOT NULL,
+	sender_mxid     TEXT NOT NULL,
+	emoji           TEXT NOT NULL,
+	event_id        TEXT NOT NULL UNIQUE,
+
+	PRIMARY KEY (target_event_id, sender_mxid, emoji)
+);
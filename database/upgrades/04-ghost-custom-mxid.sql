@@ -0,0 +1,4 @@
+-- v4: Add custom MXIDs to ghosts
+
+ALTER TABLE ghost ADD COLUMN custom_mxid TEXT;
+ALTER TABLE ghost ADD COLUMN access_token TEXT NOT NULL DEFAULT '';
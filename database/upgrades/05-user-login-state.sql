@@ -0,0 +1,3 @@
+-- v5: Add login state to users
+
+ALTER TABLE "user" ADD COLUMN login_state TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+-- v6: Add remote credentials to users
+
+ALTER TABLE "user" ADD COLUMN remote_credentials TEXT;
@@ -0,0 +1,6 @@
+-- v7: Add profile sync state to ghosts
+
+ALTER TABLE ghost ADD COLUMN name_set BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE ghost ADD COLUMN avatar_source TEXT NOT NULL DEFAULT '';
+ALTER TABLE ghost ADD COLUMN avatar_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE ghost ADD COLUMN profile_synced_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+-- v8: Add roles of ghosts in rooms
+
+ALTER TABLE room_ghost ADD COLUMN role TEXT NOT NULL DEFAULT '';
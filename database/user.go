@@ -0,0 +1,77 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/dvcrn/matrix-bridgekit/matrix"
+)
+
+const (
+	getUserByMXIDQuery = `
+		SELECT mxid, remote_id, remote_name, display_name, permission_level, management_room, access_token, login_state, remote_credentials
+		FROM "user" WHERE mxid=$1
+	`
+	getAllUserIDsQuery = `SELECT mxid FROM "user"`
+	upsertUserQuery    = `
+		INSERT INTO "user" (mxid, remote_id, remote_name, display_name, permission_level, management_room, access_token, login_state, remote_credentials)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (mxid) DO UPDATE
+			SET remote_id=excluded.remote_id, remote_name=excluded.remote_name, display_name=excluded.display_name,
+			    permission_level=excluded.permission_level, management_room=excluded.management_room,
+			    access_token=excluded.access_token, login_state=excluded.login_state,
+			    remote_credentials=excluded.remote_credentials
+	`
+)
+
+// GetUserByMXID returns the user with the given Matrix user ID, or nil if it's not stored.
+func (db *Database) GetUserByMXID(ctx context.Context, userID id.UserID) (*matrix.User, error) {
+	var user matrix.User
+	var managementRoom sql.NullString
+	err := db.QueryRow(ctx, getUserByMXIDQuery, userID).Scan(
+		&user.MXID, &user.RemoteID, &user.RemoteName, &user.DisplayName, &user.PermissionLevel, &managementRoom, &user.AccessToken, &user.LoginState,
+		dbutil.JSON{Data: &user.Credentials},
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	user.ManagementRoomID = id.RoomID(managementRoom.String)
+	return &user, nil
+}
+
+// GetAllUserIDs returns the Matrix user IDs of all stored users.
+func (db *Database) GetAllUserIDs(ctx context.Context) ([]id.UserID, error) {
+	rows, err := db.Query(ctx, getAllUserIDsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIDs := []id.UserID{}
+	for rows.Next() {
+		var userID id.UserID
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	return userIDs, rows.Err()
+}
+
+// PutUser inserts the user, or updates it if it already exists.
+func (db *Database) PutUser(ctx context.Context, user *matrix.User) error {
+	_, err := db.Exec(ctx, upsertUserQuery,
+		user.MXID, user.RemoteID, user.RemoteName, user.DisplayName, user.PermissionLevel,
+		dbutil.StrPtr(user.ManagementRoomID), user.GetAccessToken(), user.LoginState,
+		dbutil.JSON{Data: user.Credentials},
+	)
+	return err
+}
@@ -0,0 +1,45 @@
+package matrix
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dvcrn/matrix-bridgekit/media"
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/id"
+)
+
+// fetchAvatar downloads the avatar at the given URL and prepares it for uploading.
+// Anything that isn't an image is rejected, such as error pages that are served with a 200 status.
+// Animated avatars are kept if they fit in the upload limit of the homeserver.
+func fetchAvatar(ctx context.Context, br *bridge.Bridge, fetcher *media.Fetcher, url string) (*media.Avatar, error) {
+	fetched, err := fetcher.Fetch(ctx, url, "image/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to download avatar: %w", err)
+	}
+
+	avatar, err := media.PrepareAvatar(fetched.Data, media.DefaultMaxAvatarSize, br.MediaConfig.UploadSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare avatar: %w", err)
+	}
+	zerolog.Ctx(ctx).Debug().
+		Str("mime_type", avatar.MimeType).
+		Int("width", avatar.Width).
+		Int("height", avatar.Height).
+		Int("size", len(avatar.Data)).
+		Msg("Prepared avatar")
+
+	return avatar, nil
+}
+
+// uploadAvatar uploads the given avatar to Matrix as the bridge bot.
+func uploadAvatar(ctx context.Context, br *bridge.Bridge, avatar *media.Avatar) (id.ContentURI, error) {
+	resp, err := br.AS.BotClient().UploadBytes(ctx, avatar.Data, avatar.MimeType)
+	if err != nil {
+		return id.ContentURI{}, fmt.Errorf("failed to upload avatar to Matrix: %w", err)
+	}
+
+	return resp.ContentURI, nil
+}
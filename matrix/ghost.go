@@ -1,6 +1,10 @@
 package matrix
 
 import (
+	"context"
+	"errors"
+	"sync"
+
 	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/id"
@@ -15,8 +19,24 @@ type Ghost struct {
 	DisplayName string        `json:"display_name,omitempty"`
 	UserName    string        `json:"user_name,omitempty"`
 	AvatarURL   id.ContentURI `json:"avatar_url,omitempty"`
+	// NameSet is true if DisplayName has been set on the Matrix profile of the ghost.
+	NameSet bool `json:"name_set,omitempty"`
+	// AvatarSource is the remote URL that AvatarURL was downloaded from.
+	AvatarSource string `json:"avatar_source,omitempty"`
+	// AvatarHash is the hex encoded SHA-256 hash of the avatar image.
+	AvatarHash string `json:"avatar_hash,omitempty"`
+	// ProfileSyncedAt is the unix timestamp in milliseconds of the last GhostMaster.SyncProfile call.
+	ProfileSyncedAt int64 `json:"profile_synced_at,omitempty"`
+	// CustomMXID is the real Matrix user that this ghost is double puppeted by, if any.
+	// Use GetCustomMXID and GetAccessToken to read it while the ghost is in use.
+	CustomMXID  id.UserID `json:"custom_mxid,omitempty"`
+	AccessToken string    `json:"access_token,omitempty"`
+
+	customIntent *appservice.IntentAPI `json:"-"`
+	ghostMaster  *GhostMaster          `json:"-"`
 
-	ghostMaster *GhostMaster `json:"-"`
+	// lock guards CustomMXID, AccessToken, customIntent and ghostMaster, which change while the ghost is shared
+	lock sync.RWMutex
 }
 
 func (g *Ghost) GetDisplayname() string {
@@ -27,26 +47,88 @@ func (g *Ghost) GetAvatarURL() id.ContentURI {
 	return g.AvatarURL
 }
 
+// CustomIntent returns the intent of the custom MXID, or nil if the ghost isn't double puppeted.
 func (g *Ghost) CustomIntent() *appservice.IntentAPI {
-	panic("[CustomIntent] implement me")
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	return g.customIntent
+}
+
+// GetCustomMXID returns the real Matrix user that this ghost is double puppeted by, if any.
+func (g *Ghost) GetCustomMXID() id.UserID {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	return g.CustomMXID
+}
+
+// GetAccessToken returns the access token of the custom MXID.
+func (g *Ghost) GetAccessToken() string {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	return g.AccessToken
+}
+
+// setCustomMXID replaces the custom MXID of the ghost, its access token and intent.
+func (g *Ghost) setCustomMXID(userID id.UserID, accessToken string, intent *appservice.IntentAPI) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.CustomMXID = userID
+	g.AccessToken = accessToken
+	g.customIntent = intent
 }
 
+// master returns the GhostMaster that loaded the ghost, or nil if it isn't loaded.
+func (g *Ghost) master() *GhostMaster {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	return g.ghostMaster
+}
+
+// SwitchCustomMXID implements bridge.DoublePuppet, see SwitchCustomMXIDContext.
 func (g *Ghost) SwitchCustomMXID(accessToken string, userID id.UserID) error {
-	panic("[SwitchCustomMXID] implement me")
+	return g.SwitchCustomMXIDContext(context.Background(), accessToken, userID)
 }
 
+// SwitchCustomMXIDContext makes the ghost act as the Matrix user with the given access token.
+func (g *Ghost) SwitchCustomMXIDContext(ctx context.Context, accessToken string, userID id.UserID) error {
+	pm := g.master()
+	if pm == nil {
+		return errors.New("ghost is not loaded")
+	}
+
+	return pm.SwitchCustomMXID(ctx, g, accessToken, userID)
+}
+
+// ClearCustomMXID implements bridge.DoublePuppet, see ClearCustomMXIDContext.
 func (g *Ghost) ClearCustomMXID() {
-	panic("[ClearCustomMXID] implement me")
+	g.ClearCustomMXIDContext(context.Background())
+}
+
+// ClearCustomMXIDContext stops double puppeting the ghost.
+func (g *Ghost) ClearCustomMXIDContext(ctx context.Context) {
+	pm := g.master()
+	if pm == nil {
+		g.setCustomMXID("", "", nil)
+		return
+	}
+
+	pm.ClearCustomMXID(ctx, g)
 }
 
 // DefaultIntent gets the intent to act as this ghost
 // Deprecated: use PuppetMaster.As
 func (g *Ghost) DefaultIntent() *appservice.IntentAPI {
-	if g.ghostMaster == nil {
+	pm := g.master()
+	if pm == nil {
 		return nil
 	}
 
-	return g.ghostMaster.AsGhost(g)
+	return pm.AsGhost(g)
 }
 
 func (g *Ghost) GetMXID() id.UserID {
@@ -0,0 +1,112 @@
+package matrix
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// GhostProfile is the profile of a remote user, as reported by the remote network.
+type GhostProfile struct {
+	// DisplayName is the name of the ghost. An empty name leaves the current name untouched.
+	DisplayName string
+	// AvatarSource is the URL to download the avatar from. An empty source removes the avatar.
+	AvatarSource string
+}
+
+// SyncProfile brings the Matrix profile of the ghost up to date with the given remote profile.
+// Only the parts that changed are updated: the name is compared to the stored name, and the avatar is only
+// downloaded if its source URL changed, and only uploaded if its content changed.
+// Returns whether anything changed. The time of the sync is stored on the ghost in either case.
+func (pm *GhostMaster) SyncProfile(ctx context.Context, ghost *Ghost, profile GhostProfile) (bool, error) {
+	log := pm.log.With().Stringer("ghost_id", ghost.MXID).Logger()
+
+	nameChanged, err := pm.syncName(ctx, ghost, profile.DisplayName)
+	if err != nil {
+		log.Err(err).Msg("Failed to update ghost name")
+	}
+
+	avatarChanged, avatarErr := pm.syncAvatar(ctx, ghost, profile.AvatarSource)
+	if avatarErr != nil {
+		log.Err(avatarErr).Msg("Failed to update ghost avatar")
+		if err == nil {
+			err = avatarErr
+		}
+	}
+
+	ghost.ProfileSyncedAt = time.Now().UnixMilli()
+	if putErr := pm.store.PutGhost(ctx, ghost); putErr != nil && err == nil {
+		err = putErr
+	}
+
+	return nameChanged || avatarChanged, err
+}
+
+// syncName sets the display name of the ghost if it differs from the name that was set last time.
+func (pm *GhostMaster) syncName(ctx context.Context, ghost *Ghost, name string) (bool, error) {
+	if name == "" || (ghost.NameSet && ghost.DisplayName == name) {
+		return false, nil
+	}
+
+	ghost.DisplayName = name
+	ghost.NameSet = false
+	if err := pm.AsGhost(ghost).SetDisplayName(ctx, name); err != nil {
+		return true, err
+	}
+	ghost.NameSet = true
+
+	return true, nil
+}
+
+// syncAvatar sets the avatar of the ghost to the image at the given source URL.
+// Nothing is downloaded if the source didn't change since the last sync, and nothing is uploaded if the
+// downloaded image has the same hash as the current avatar.
+func (pm *GhostMaster) syncAvatar(ctx context.Context, ghost *Ghost, source string) (bool, error) {
+	if source == ghost.AvatarSource && (source == "" || !ghost.AvatarURL.IsEmpty()) {
+		return false, nil
+	}
+
+	if source == "" {
+		if err := pm.AsGhost(ghost).SetAvatarURL(ctx, id.ContentURI{}); err != nil {
+			return false, fmt.Errorf("failed to remove avatar: %w", err)
+		}
+
+		ghost.AvatarURL = id.ContentURI{}
+		ghost.AvatarSource = ""
+		ghost.AvatarHash = ""
+		return true, nil
+	}
+
+	avatar, err := fetchAvatar(ctx, pm.bridge, pm.MediaFetcher, source)
+	if err != nil {
+		return false, err
+	}
+
+	hash := sha256.Sum256(avatar.Data)
+	hashStr := hex.EncodeToString(hash[:])
+	if hashStr == ghost.AvatarHash && !ghost.AvatarURL.IsEmpty() {
+		// same image under a new URL
+		ghost.AvatarSource = source
+		return true, nil
+	}
+
+	contentURI, err := uploadAvatar(ctx, pm.bridge, avatar)
+	if err != nil {
+		return false, err
+	}
+	pm.log.Debug().Stringer("ghost_id", ghost.MXID).Stringer("avatar_url", contentURI).Msg("Uploaded ghost avatar")
+
+	if err := pm.AsGhost(ghost).SetAvatarURL(ctx, contentURI); err != nil {
+		return false, fmt.Errorf("failed to set avatar: %w", err)
+	}
+
+	ghost.AvatarURL = contentURI
+	ghost.AvatarSource = source
+	ghost.AvatarHash = hashStr
+
+	return true, nil
+}
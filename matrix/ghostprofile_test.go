@@ -0,0 +1,94 @@
+package matrix
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestSyncProfileUnchanged(t *testing.T) {
+	avatarURL := id.ContentURI{Homeserver: "example.com", FileID: "avatar"}
+
+	tests := []struct {
+		name    string
+		ghost   *Ghost
+		profile GhostProfile
+	}{
+		{
+			name:    "same name and avatar source",
+			ghost:   &Ghost{DisplayName: "Alice", NameSet: true, AvatarSource: "https://example.com/a.png", AvatarURL: avatarURL},
+			profile: GhostProfile{DisplayName: "Alice", AvatarSource: "https://example.com/a.png"},
+		},
+		{
+			name:    "empty name is ignored",
+			ghost:   &Ghost{DisplayName: "Alice", NameSet: true},
+			profile: GhostProfile{},
+		},
+		{
+			name:    "no avatar before and after",
+			ghost:   &Ghost{DisplayName: "Alice", NameSet: true},
+			profile: GhostProfile{DisplayName: "Alice"},
+		},
+	}
+
+	pm := NewGhostMaster(newTestBridge(), "test", memoryGhostStore{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ghost := tt.ghost
+			ghost.MXID = "@test_alice:example.com"
+
+			changed, err := pm.SyncProfile(context.Background(), ghost, tt.profile)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if changed {
+				t.Fatal("expected no change")
+			}
+			if ghost.ProfileSyncedAt == 0 {
+				t.Fatal("expected the sync time to be stored")
+			}
+		})
+	}
+}
+
+func TestSyncAvatarSameImageNewSource(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("failed to encode avatar: %v", err)
+	}
+	data := buf.Bytes()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	hash := sha256.Sum256(data)
+	avatarURL := id.ContentURI{Homeserver: "example.com", FileID: "avatar"}
+	ghost := &Ghost{
+		MXID:         "@test_alice:example.com",
+		AvatarSource: server.URL + "/old.png",
+		AvatarURL:    avatarURL,
+		AvatarHash:   hex.EncodeToString(hash[:]),
+	}
+
+	pm := NewGhostMaster(newTestBridge(), "test", memoryGhostStore{})
+	changed, err := pm.syncAvatar(context.Background(), ghost, server.URL+"/new.png")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !changed {
+		t.Fatal("expected the new source to be recorded")
+	}
+
+	if ghost.AvatarSource != server.URL+"/new.png" || ghost.AvatarURL != avatarURL {
+		t.Fatalf("expected only the source to change, got %s %s", ghost.AvatarSource, ghost.AvatarURL)
+	}
+}
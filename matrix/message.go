@@ -11,4 +11,29 @@ type Message struct {
 	RoomID    id.RoomID                 `json:"room_id,omitempty"`
 	Content   event.MessageEventContent `json:"content"`
 	Timestamp int64                     `json:"timestamp,omitempty"`
+
+	// RemoteID is the ID of the message on the remote network. If set, the event ID of the
+	// bridged message is recorded so that it can be looked up later for edits, reactions and redactions.
+	RemoteID string `json:"remote_id,omitempty"`
+	// PartIndex is the index of this part if a remote message is bridged as multiple Matrix events.
+	PartIndex int `json:"part_index,omitempty"`
+}
+
+// BridgedMessage maps one part of a remote message to the Matrix event it was bridged as.
+type BridgedMessage struct {
+	RoomID     id.RoomID  `json:"room_id,omitempty"`
+	RemoteID   string     `json:"remote_id,omitempty"`
+	PartIndex  int        `json:"part_index,omitempty"`
+	EventID    id.EventID `json:"event_id,omitempty"`
+	SenderMXID id.UserID  `json:"sender_mxid,omitempty"`
+	Timestamp  int64      `json:"timestamp,omitempty"`
+}
+
+// Reaction is a reaction that was bridged to Matrix, stored so it can be deduplicated and removed later.
+type Reaction struct {
+	RoomID        id.RoomID  `json:"room_id,omitempty"`
+	TargetEventID id.EventID `json:"target_event_id,omitempty"`
+	SenderMXID    id.UserID  `json:"sender_mxid,omitempty"`
+	Key           string     `json:"key,omitempty"`
+	EventID       id.EventID `json:"event_id,omitempty"`
 }
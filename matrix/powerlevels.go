@@ -1,27 +1,194 @@
 package matrix
 
 import (
+	"errors"
+	"fmt"
+	"maps"
+
+	"gopkg.in/yaml.v3"
+
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
-func NewBasePowerLevels() *event.PowerLevelsEventContent {
-	var anyone = 0
-	var disabled = 99
+// ErrInvalidPowerLevelPolicy is returned by PowerLevelPolicy.Validate.
+var ErrInvalidPowerLevelPolicy = errors.New("invalid power level policy")
 
-	return &event.PowerLevelsEventContent{
-		UsersDefault:    anyone,
-		EventsDefault:   anyone,
-		RedactPtr:       &anyone,
-		StateDefaultPtr: &disabled,
-		BanPtr:          &disabled,
-		KickPtr:         &disabled,
-		InvitePtr:       &disabled,
+// PowerLevelPolicy describes the power levels of bridged rooms. It has YAML tags, so it can be embedded in the bridge config.
+// Fields that are missing in the YAML keep the values of DefaultPowerLevelPolicy. When building a policy in code,
+// start from DefaultPowerLevelPolicy, as zero values are used as-is.
+type PowerLevelPolicy struct {
+	// Bot is the level of the bridge bot. It needs to be higher than all other levels.
+	Bot int `yaml:"bot"`
+	// Ghost is the level of ghosts that are members. It needs to be lower than Moderator, so that roles stand out.
+	Ghost int `yaml:"ghost"`
+	// Admin is the level of ghosts of remote admins.
+	Admin int `yaml:"admin"`
+	// Moderator is the level of ghosts of remote moderators.
+	Moderator int `yaml:"moderator"`
+	// User is the level of the bridged Matrix user.
+	User int `yaml:"user"`
+
+	UsersDefault  int            `yaml:"users_default"`
+	EventsDefault int            `yaml:"events_default"`
+	StateDefault  int            `yaml:"state_default"`
+	Invite        int            `yaml:"invite"`
+	Kick          int            `yaml:"kick"`
+	Ban           int            `yaml:"ban"`
+	Redact        int            `yaml:"redact"`
+	Events        map[string]int `yaml:"events"`
+
+	// ReadOnly is the level needed to send messages and reactions in rooms marked as read-only.
+	ReadOnly int `yaml:"read_only"`
+	// ReadOnlyGhost is the level of ghosts in rooms marked as read-only, so that they can still send.
+	ReadOnlyGhost int `yaml:"read_only_ghost"`
+}
+
+// DefaultPowerLevelPolicy returns the policy that bridgekit uses if the bridge doesn't configure one.
+// Everyone can send messages, reactions and redactions and change the room name and avatar,
+// while other state and moderation are reserved for the bot and ghosts.
+func DefaultPowerLevelPolicy() PowerLevelPolicy {
+	return PowerLevelPolicy{
+		Bot:       9001,
+		Ghost:     0,
+		Admin:     100,
+		Moderator: 50,
+		User:      0,
+
+		UsersDefault:  0,
+		EventsDefault: 0,
+		StateDefault:  99,
+		Invite:        99,
+		Kick:          99,
+		Ban:           99,
+		Redact:        0,
 		Events: map[string]int{
-			event.StateRoomName.Type:   anyone,
-			event.StateRoomAvatar.Type: anyone,
-			event.EventReaction.Type:   anyone,
-			event.EventRedaction.Type:  anyone,
-			event.EventMessage.Type:    anyone,
+			event.StateRoomName.Type:   0,
+			event.StateRoomAvatar.Type: 0,
+			event.EventReaction.Type:   0,
+			event.EventRedaction.Type:  0,
+			event.EventMessage.Type:    0,
 		},
+
+		ReadOnly:      101,
+		ReadOnlyGhost: 102,
+	}
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler. The policy is decoded over DefaultPowerLevelPolicy,
+// and configured events are merged into the default events.
+func (p *PowerLevelPolicy) UnmarshalYAML(node *yaml.Node) error {
+	type rawPolicy PowerLevelPolicy
+	raw := rawPolicy(DefaultPowerLevelPolicy())
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+
+	*p = PowerLevelPolicy(raw)
+	return nil
+}
+
+// Validate checks that the bot level is higher than the levels that the policy gives to ghosts and users,
+// as the bot couldn't change their levels or manage the room otherwise. It also checks that ghosts rank below
+// moderators and that moderators don't rank above admins.
+func (p PowerLevelPolicy) Validate() error {
+	levels := []struct {
+		name  string
+		level int
+	}{
+		{"ghost", p.Ghost},
+		{"admin", p.Admin},
+		{"moderator", p.Moderator},
+		{"user", p.User},
+		{"users_default", p.UsersDefault},
+		{"read_only_ghost", p.ReadOnlyGhost},
+	}
+
+	for _, l := range levels {
+		if l.level >= p.Bot {
+			return fmt.Errorf("%w: bot level %d isn't higher than %s level %d", ErrInvalidPowerLevelPolicy, p.Bot, l.name, l.level)
+		}
+	}
+
+	if p.Ghost >= p.Moderator {
+		return fmt.Errorf("%w: ghost level %d isn't lower than moderator level %d", ErrInvalidPowerLevelPolicy, p.Ghost, p.Moderator)
+	} else if p.Moderator > p.Admin {
+		return fmt.Errorf("%w: moderator level %d is higher than admin level %d", ErrInvalidPowerLevelPolicy, p.Moderator, p.Admin)
+	}
+
+	return nil
+}
+
+// RoleLevel returns the level of ghosts with the given role.
+func (p PowerLevelPolicy) RoleLevel(role GhostRole) int {
+	switch role {
+	case GhostRoleAdmin:
+		return p.Admin
+	case GhostRoleModerator:
+		return p.Moderator
+	default:
+		return p.Ghost
+	}
+}
+
+// PowerLevels generates the power levels for the given room with the given bot and bridged users.
+// Ghosts get the level of their role in the room. Users are only listed if their level differs from UsersDefault.
+func (p PowerLevelPolicy) PowerLevels(bot id.UserID, room *Room, users ...id.UserID) *event.PowerLevelsEventContent {
+	powerLevels := p.base()
+	for _, user := range users {
+		powerLevels.Users[user] = p.User
+	}
+	for _, ghost := range room.Ghosts {
+		powerLevels.Users[ghost.MXID] = p.RoleLevel(room.GhostRole(ghost.MXID))
+	}
+	powerLevels.Users[bot] = p.Bot
+
+	for userID, level := range powerLevels.Users {
+		if level == p.UsersDefault && userID != bot {
+			delete(powerLevels.Users, userID)
+		}
+	}
+
+	return powerLevels
+}
+
+// ReadOnlyPowerLevels generates the power levels for a read-only room, where only the bot and ghosts can send
+// messages and reactions.
+func (p PowerLevelPolicy) ReadOnlyPowerLevels(bot id.UserID, room *Room) *event.PowerLevelsEventContent {
+	powerLevels := p.base()
+	for _, ghost := range room.Ghosts {
+		powerLevels.Users[ghost.MXID] = max(p.ReadOnlyGhost, p.RoleLevel(room.GhostRole(ghost.MXID)))
 	}
+	powerLevels.Users[bot] = p.Bot
+
+	powerLevels.EventsDefault = p.ReadOnly
+	powerLevels.Events[event.EventReaction.Type] = p.ReadOnly
+	powerLevels.Events[event.EventMessage.Type] = p.ReadOnly
+
+	return powerLevels
+}
+
+func (p PowerLevelPolicy) base() *event.PowerLevelsEventContent {
+	stateDefault, invite, kick, ban, redact := p.StateDefault, p.Invite, p.Kick, p.Ban, p.Redact
+	events := maps.Clone(p.Events)
+	if events == nil {
+		events = make(map[string]int)
+	}
+
+	return &event.PowerLevelsEventContent{
+		Users:           make(map[id.UserID]int),
+		UsersDefault:    p.UsersDefault,
+		EventsDefault:   p.EventsDefault,
+		StateDefaultPtr: &stateDefault,
+		InvitePtr:       &invite,
+		KickPtr:         &kick,
+		BanPtr:          &ban,
+		RedactPtr:       &redact,
+		Events:          events,
+	}
+}
+
+// NewBasePowerLevels returns the power levels of DefaultPowerLevelPolicy without any users.
+func NewBasePowerLevels() *event.PowerLevelsEventContent {
+	return DefaultPowerLevelPolicy().base()
 }
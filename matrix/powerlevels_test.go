@@ -0,0 +1,195 @@
+package matrix
+
+import (
+	"errors"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	testBot  id.UserID = "@bot:example.com"
+	testUser id.UserID = "@user:example.com"
+)
+
+func TestPowerLevelPolicyPowerLevels(t *testing.T) {
+	room := &Room{Ghosts: []*Ghost{
+		{MXID: "@test_admin:example.com"},
+		{MXID: "@test_mod:example.com"},
+		{MXID: "@test_member:example.com"},
+	}}
+	room.SetGhostRole("@test_admin:example.com", GhostRoleAdmin)
+	room.SetGhostRole("@test_mod:example.com", GhostRoleModerator)
+
+	raisedUser := DefaultPowerLevelPolicy()
+	raisedUser.User = 10
+
+	tests := []struct {
+		name     string
+		policy   PowerLevelPolicy
+		readOnly bool
+		want     map[id.UserID]int
+		events   map[string]int
+	}{
+		{
+			name:   "default",
+			policy: DefaultPowerLevelPolicy(),
+			want: map[id.UserID]int{
+				testBot:                   9001,
+				"@test_admin:example.com": 100,
+				"@test_mod:example.com":   50,
+			},
+			events: map[string]int{event.EventMessage.Type: 0, event.EventReaction.Type: 0},
+		},
+		{
+			name:   "levels equal to users default are left out",
+			policy: raisedUser,
+			want: map[id.UserID]int{
+				testBot:                   9001,
+				testUser:                  10,
+				"@test_admin:example.com": 100,
+				"@test_mod:example.com":   50,
+			},
+			events: map[string]int{event.EventMessage.Type: 0},
+		},
+		{
+			name:     "read-only",
+			policy:   DefaultPowerLevelPolicy(),
+			readOnly: true,
+			want: map[id.UserID]int{
+				testBot:                    9001,
+				"@test_admin:example.com":  102,
+				"@test_mod:example.com":    102,
+				"@test_member:example.com": 102,
+			},
+			events: map[string]int{event.EventMessage.Type: 101, event.EventReaction.Type: 101},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *event.PowerLevelsEventContent
+			if tt.readOnly {
+				got = tt.policy.ReadOnlyPowerLevels(testBot, room)
+			} else {
+				got = tt.policy.PowerLevels(testBot, room, testUser)
+			}
+
+			if len(got.Users) != len(tt.want) {
+				t.Fatalf("expected users %v, got %v", tt.want, got.Users)
+			}
+			for userID, level := range tt.want {
+				if got.Users[userID] != level {
+					t.Errorf("expected level %d for %s, got %d", level, userID, got.Users[userID])
+				}
+			}
+			for eventType, level := range tt.events {
+				if got.Events[eventType] != level {
+					t.Errorf("expected level %d for %s, got %d", level, eventType, got.Events[eventType])
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultPowerLevelPolicyOrdering(t *testing.T) {
+	p := DefaultPowerLevelPolicy()
+	if !(p.Ghost < p.Moderator && p.Moderator < p.Admin && p.Admin < p.Bot) {
+		t.Fatalf("expected ghost < moderator < admin < bot, got %d, %d, %d, %d", p.Ghost, p.Moderator, p.Admin, p.Bot)
+	}
+}
+
+func TestPowerLevelPolicyEventsAreCopied(t *testing.T) {
+	policy := DefaultPowerLevelPolicy()
+	policy.ReadOnlyPowerLevels(testBot, &Room{})
+
+	if policy.Events[event.EventMessage.Type] != 0 {
+		t.Fatal("expected the events of the policy to be left untouched")
+	}
+}
+
+func TestPowerLevelPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(p *PowerLevelPolicy)
+		wantErr bool
+	}{
+		{"default", func(p *PowerLevelPolicy) {}, false},
+		{"zero bot", func(p *PowerLevelPolicy) { p.Bot = 0 }, true},
+		{"admin equal to bot", func(p *PowerLevelPolicy) { p.Admin = p.Bot }, true},
+		{"user above bot", func(p *PowerLevelPolicy) { p.User = p.Bot + 1 }, true},
+		{"read-only ghost above bot", func(p *PowerLevelPolicy) { p.Bot = 101 }, true},
+		{"lower bot", func(p *PowerLevelPolicy) { p.Bot = 103 }, false},
+		{"ghost equal to moderator", func(p *PowerLevelPolicy) { p.Ghost = p.Moderator }, true},
+		{"ghost above moderator", func(p *PowerLevelPolicy) { p.Ghost = 100 }, true},
+		{"moderator above admin", func(p *PowerLevelPolicy) { p.Moderator = p.Admin + 1 }, true},
+		{"moderator equal to admin", func(p *PowerLevelPolicy) { p.Moderator = p.Admin }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := DefaultPowerLevelPolicy()
+			tt.modify(&policy)
+
+			err := policy.Validate()
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			} else if err != nil && !errors.Is(err, ErrInvalidPowerLevelPolicy) {
+				t.Fatalf("expected ErrInvalidPowerLevelPolicy, got %v", err)
+			}
+		})
+	}
+}
+
+func TestPowerLevelPolicyUnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		check func(t *testing.T, p PowerLevelPolicy)
+	}{
+		{
+			name: "empty keeps the defaults",
+			yaml: "{}",
+			check: func(t *testing.T, p PowerLevelPolicy) {
+				if p.Bot != 9001 || p.Ghost != 0 || p.ReadOnly != 101 {
+					t.Fatalf("expected default levels, got %+v", p)
+				}
+			},
+		},
+		{
+			name: "set fields override the defaults",
+			yaml: "ghost: 10\nmoderator: 60",
+			check: func(t *testing.T, p PowerLevelPolicy) {
+				if p.Ghost != 10 || p.Moderator != 60 || p.Bot != 9001 || p.Admin != 100 {
+					t.Fatalf("unexpected levels %+v", p)
+				}
+			},
+		},
+		{
+			name: "events are merged",
+			yaml: "events:\n  m.room.topic: 50",
+			check: func(t *testing.T, p PowerLevelPolicy) {
+				if p.Events["m.room.topic"] != 50 {
+					t.Fatalf("expected configured event level, got %v", p.Events)
+				}
+				if _, ok := p.Events[event.EventMessage.Type]; !ok {
+					t.Fatalf("expected default events to be kept, got %v", p.Events)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var policy PowerLevelPolicy
+			if err := yaml.Unmarshal([]byte(tt.yaml), &policy); err != nil {
+				t.Fatalf("failed to unmarshal: %v", err)
+			}
+
+			tt.check(t, policy)
+		})
+	}
+}
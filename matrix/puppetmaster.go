@@ -3,8 +3,11 @@ package matrix
 import (
 	"context"
 	"fmt"
-	"io"
-	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/dvcrn/matrix-bridgekit/media"
+	"github.com/rs/zerolog"
 
 	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/bridge"
@@ -17,24 +20,88 @@ type userGhostConfig struct {
 	ghost              *Ghost
 }
 
+// GhostStore persists the ghost and user state that is managed by the GhostMaster,
+// such as display names and double puppet access tokens.
+type GhostStore interface {
+	GetGhostByMXID(ctx context.Context, userID id.UserID) (*Ghost, error)
+	PutGhost(ctx context.Context, ghost *Ghost) error
+	PutUser(ctx context.Context, user *User) error
+}
+
+// GhostMaster is safe for concurrent use. Setting up the ghost or double puppet of a user only happens once
+// at a time per user, concurrent callers wait for it and use the result.
 type GhostMaster struct {
-	bridge          *bridge.Bridge
-	localpart       string
+	bridge    *bridge.Bridge
+	localpart string
+	store     GhostStore
+	log       zerolog.Logger
+
+	// MediaFetcher downloads ghost avatars. Defaults to media.DefaultFetcher.
+	MediaFetcher *media.Fetcher
+
+	// lock guards userGhostConfig and setupLocks. The double puppet state of users and ghosts is guarded by their own locks.
+	lock            sync.RWMutex
 	userGhostConfig map[id.UserID]*userGhostConfig
+	setupLocks      map[id.UserID]*sync.Mutex
 }
 
-func NewGhostMaster(bridge *bridge.Bridge, localpart string) *GhostMaster {
+func NewGhostMaster(bridge *bridge.Bridge, localpart string, store GhostStore) *GhostMaster {
 	return &GhostMaster{
 		bridge:          bridge,
 		localpart:       localpart,
+		store:           store,
+		log:             bridge.ZLog.With().Str("component", "ghost master").Logger(),
+		MediaFetcher:    media.DefaultFetcher(),
 		userGhostConfig: make(map[id.UserID]*userGhostConfig),
+		setupLocks:      make(map[id.UserID]*sync.Mutex),
 	}
 }
 
+// getUserGhostConfig returns a copy of the ghost config of the given user.
+func (pm *GhostMaster) getUserGhostConfig(userID id.UserID) (userGhostConfig, bool) {
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+
+	conf, ok := pm.userGhostConfig[userID]
+	if !ok {
+		return userGhostConfig{}, false
+	}
+
+	return *conf, true
+}
+
+// updateUserGhostConfig calls fn with the ghost config of the given user, creating it if needed.
+func (pm *GhostMaster) updateUserGhostConfig(userID id.UserID, fn func(conf *userGhostConfig)) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	conf, ok := pm.userGhostConfig[userID]
+	if !ok {
+		conf = &userGhostConfig{userMXID: userID}
+		pm.userGhostConfig[userID] = conf
+	}
+
+	fn(conf)
+}
+
+// setupLock returns the lock that serialises setting up the given user or ghost.
+func (pm *GhostMaster) setupLock(userID id.UserID) *sync.Mutex {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	l, ok := pm.setupLocks[userID]
+	if !ok {
+		l = &sync.Mutex{}
+		pm.setupLocks[userID] = l
+	}
+
+	return l
+}
+
 // NewGhost creates a new ghost user with the given remote ID, display name, username and avatar URL.
 func (pm *GhostMaster) NewGhost(remoteID string, displayName, userName string, avatarURL id.ContentURI) *Ghost {
 	mxid := id.NewUserID(fmt.Sprintf("%s_%s", pm.localpart, userName), pm.bridge.Config.Homeserver.Domain)
-	fmt.Println("[CreatePuppet] ", userName, mxid.String())
+	pm.log.Debug().Str("user_name", userName).Stringer("ghost_id", mxid).Msg("Creating ghost")
 
 	return &Ghost{
 		MXID:        mxid,
@@ -46,18 +113,40 @@ func (pm *GhostMaster) NewGhost(remoteID string, displayName, userName string, a
 	}
 }
 
+// IsGhostMXID checks whether the given user ID is inside the ghost namespace of the bridge.
+func (pm *GhostMaster) IsGhostMXID(userID id.UserID) bool {
+	localpart, homeserver, err := userID.Parse()
+	if err != nil || homeserver != pm.bridge.Config.Homeserver.Domain {
+		return false
+	}
+
+	return strings.HasPrefix(localpart, pm.localpart+"_")
+}
+
 // LoadGhost loads the intent for the given ghost and fills it into the struct.
 // Deprecated: Use GhostMaster.AsGhost instead
 func (pm *GhostMaster) LoadGhost(ghost *Ghost) *Ghost {
+	ghost.lock.Lock()
+	defer ghost.lock.Unlock()
+
 	ghost.ghostMaster = pm
 	return ghost
 }
 
+// LoadUser attaches the GhostMaster to the given user, so that the double puppet and ghost getters of the user work.
+func (pm *GhostMaster) LoadUser(user *User) *User {
+	user.doublePuppetLock.Lock()
+	defer user.doublePuppetLock.Unlock()
+
+	user.ghostMaster = pm
+	return user
+}
+
 // HasDoublePuppet checks if the user has a doublePuppet intent.
 // This will NOT try to setup the double puppet intent if it doesn't already exist yet,
 // so even if the user theoretically can double puppet, Setup has to get called first.
 func (pm *GhostMaster) HasDoublePuppet(user *User) bool {
-	userGhostConfig, ok := pm.userGhostConfig[user.MXID]
+	userGhostConfig, ok := pm.getUserGhostConfig(user.MXID)
 	if !ok {
 		return false
 	}
@@ -68,7 +157,7 @@ func (pm *GhostMaster) HasDoublePuppet(user *User) bool {
 // HasUserGhost checks if we currently have any ghost information available for the given user
 // Effectively checking whether a setup for the user has been completed
 func (pm *GhostMaster) HasUserGhost(user *User) bool {
-	userGhostConfig, ok := pm.userGhostConfig[user.MXID]
+	userGhostConfig, ok := pm.getUserGhostConfig(user.MXID)
 	if !ok {
 		return false
 	}
@@ -95,7 +184,6 @@ func (pm *GhostMaster) HasUserGhost(user *User) bool {
 // 	}
 
 // 	if len(filteredGhosts) == 0 {
-// 		fmt.Println("no ghosts after filtering")
 // 		return nil
 // 	}
 
@@ -122,6 +210,9 @@ func (pm *GhostMaster) AsRoomGhostByID(room *Room, userID id.UserID) *appservice
 
 	for _, ghost := range room.Ghosts {
 		if ghost.GetMXID() == userID {
+			if intent := ghost.CustomIntent(); intent != nil {
+				return intent
+			}
 			return pm.AsGhost(ghost)
 		}
 	}
@@ -131,9 +222,36 @@ func (pm *GhostMaster) AsRoomGhostByID(room *Room, userID id.UserID) *appservice
 
 // AsGhost returns an intent to impersonate the given ghost
 func (pm *GhostMaster) AsGhost(ghost *Ghost) *appservice.IntentAPI {
-	intent := pm.bridge.AS.Intent(ghost.MXID)
-	fmt.Println("AsGhost: ", ghost.MXID, intent.UserID)
-	return intent
+	return pm.bridge.AS.Intent(ghost.MXID)
+}
+
+// AsCustomGhost returns the intent of the custom MXID if the ghost is double puppeted,
+// and the normal ghost intent otherwise.
+func (pm *GhostMaster) AsCustomGhost(ctx context.Context, ghost *Ghost) *appservice.IntentAPI {
+	if intent := ghost.CustomIntent(); intent != nil {
+		return intent
+	} else if ghost.GetCustomMXID() == "" {
+		return pm.AsGhost(ghost)
+	}
+
+	l := pm.setupLock(ghost.MXID)
+	l.Lock()
+	defer l.Unlock()
+
+	// another caller may have started it while we were waiting
+	if intent := ghost.CustomIntent(); intent != nil {
+		return intent
+	}
+
+	if err := pm.StartCustomMXID(ctx, ghost); err != nil {
+		pm.log.Warn().Err(err).Stringer("ghost_id", ghost.MXID).Msg("Failed to start custom MXID of ghost")
+	}
+
+	if intent := ghost.CustomIntent(); intent != nil {
+		return intent
+	}
+
+	return pm.AsGhost(ghost)
 }
 
 // AsBot is returning an intent to impersonate the bridge bot
@@ -147,14 +265,11 @@ func (pm *GhostMaster) AsBot() *appservice.IntentAPI {
 // If not, it tries to setup double puppeting for the user.
 // If that fails, it tries to create a ghost for the current user.
 func (pm *GhostMaster) AsUserGhost(ctx context.Context, user *User) *appservice.IntentAPI {
-	fmt.Println("AsUserGhost: ", user.MXID)
-	userGhostConfig, ok := pm.userGhostConfig[user.MXID]
-	if !ok {
-		fmt.Println("not processed yet")
-		pm.SetupDoublePuppet(ctx, user)
-		pm.SetupUserGhost(ctx, user)
-
-		userGhostConfig, ok = pm.userGhostConfig[user.MXID]
+	log := pm.log.With().Stringer("user_id", user.MXID).Logger()
+	ctx = log.WithContext(ctx)
+	userGhostConfig, ok := pm.getUserGhostConfig(user.MXID)
+	if !ok || (userGhostConfig.doublePuppetIntent == nil && userGhostConfig.ghost == nil) {
+		userGhostConfig = pm.setupUser(ctx, user)
 	}
 
 	if userGhostConfig.doublePuppetIntent != nil {
@@ -162,93 +277,178 @@ func (pm *GhostMaster) AsUserGhost(ctx context.Context, user *User) *appservice.
 	}
 
 	if userGhostConfig.ghost == nil {
-		ghost, _ := pm.SetupUserGhost(ctx, user)
-		userGhostConfig.ghost = ghost
+		log.Warn().Msg("No user ghost available, using bot")
+		return pm.AsBot()
 	}
 
-	fmt.Println("no double puppet intent, using normal ghost: ", userGhostConfig.ghost)
-	return pm.AsGhost(userGhostConfig.ghost)
+	log.Trace().Stringer("ghost_id", userGhostConfig.ghost.MXID).Msg("No double puppet intent, using user ghost")
+	return pm.AsCustomGhost(ctx, userGhostConfig.ghost)
 }
 
-// UploadGhostAvatar uploads a new avatar for the given ghost and returns the new avatar URL as ContentURI.
-func (pm *GhostMaster) UploadGhostAvatar(ctx context.Context, ghost *Ghost, url string) (id.ContentURI, error) {
-	bot := pm.bridge.AS.BotClient()
+// setupUser sets up the double puppet and ghost of the given user, unless a concurrent caller already did.
+func (pm *GhostMaster) setupUser(ctx context.Context, user *User) userGhostConfig {
+	l := pm.setupLock(user.MXID)
+	l.Lock()
+	defer l.Unlock()
 
-	getResp, err := http.DefaultClient.Get(url)
-	if err != nil {
-		return id.ContentURI{}, fmt.Errorf("failed to download avatar: %w", err)
+	conf, ok := pm.getUserGhostConfig(user.MXID)
+	if !ok {
+		zerolog.Ctx(ctx).Debug().Msg("User ghost not set up yet")
+		pm.SetupDoublePuppet(ctx, user)
+	}
+	if conf.ghost == nil {
+		pm.SetupUserGhost(ctx, user)
 	}
 
-	data, err := io.ReadAll(getResp.Body)
-	_ = getResp.Body.Close()
-	if err != nil {
-		return id.ContentURI{}, fmt.Errorf("failed to read avatar bytes: %w", err)
+	conf, _ = pm.getUserGhostConfig(user.MXID)
+	return conf
+}
+
+// GetUserGhost returns the ghost that represents the given user, setting it up if needed.
+func (pm *GhostMaster) GetUserGhost(ctx context.Context, user *User) (*Ghost, error) {
+	if conf, ok := pm.getUserGhostConfig(user.MXID); ok && conf.ghost != nil {
+		return conf.ghost, nil
 	}
 
-	// upload to matrix
-	resp, err := bot.UploadBytes(ctx, data, "image/png")
-	if err != nil {
-		return id.ContentURI{}, fmt.Errorf("failed to upload avatar to Matrix: %w", err)
+	l := pm.setupLock(user.MXID)
+	l.Lock()
+	defer l.Unlock()
+
+	if conf, ok := pm.getUserGhostConfig(user.MXID); ok && conf.ghost != nil {
+		return conf.ghost, nil
 	}
-	fmt.Println("Uploaded image to matrix servers -- ", resp.ContentURI.String())
 
-	err = pm.AsGhost(ghost).SetAvatarURL(ctx, resp.ContentURI)
+	return pm.SetupUserGhost(ctx, user)
+}
+
+// loadedUserGhost returns the ghost of the given user if it has already been set up, without setting it up.
+func (pm *GhostMaster) loadedUserGhost(user *User) *Ghost {
+	if conf, ok := pm.getUserGhostConfig(user.MXID); ok {
+		return conf.ghost
+	}
 
-	return resp.ContentURI, err
+	return nil
+}
+
+// UploadGhostAvatar sets the avatar of the given ghost to the image at the given URL and returns the avatar URL as ContentURI.
+// Nothing is downloaded if the URL is the one that was used last time, and nothing is uploaded if the image didn't change.
+func (pm *GhostMaster) UploadGhostAvatar(ctx context.Context, ghost *Ghost, url string) (id.ContentURI, error) {
+	changed, err := pm.syncAvatar(ctx, ghost, url)
+	if err != nil {
+		return ghost.AvatarURL, err
+	} else if !changed {
+		return ghost.AvatarURL, nil
+	}
+
+	return ghost.AvatarURL, pm.store.PutGhost(ctx, ghost)
 }
 
-// UpdateGhostName updates the name of the given ghost.
+// UpdateGhostName updates the name of the given ghost, unless it's already set to the given name.
 func (pm *GhostMaster) UpdateGhostName(ctx context.Context, ghost *Ghost, newName string) error {
-	ghost.DisplayName = newName
-	err := pm.AsGhost(ghost).SetDisplayName(ctx, newName)
+	changed, err := pm.syncName(ctx, ghost, newName)
 	if err != nil {
-		fmt.Sprintf("could not update name: ", err.Error())
+		pm.log.Err(err).Stringer("ghost_id", ghost.MXID).Msg("Failed to update ghost name")
 		return err
+	} else if !changed {
+		return nil
 	}
 
-	return nil
+	return pm.store.PutGhost(ctx, ghost)
 }
 
 // SetupUserGhost creates a normal ghost for the given user.
 // This ghost will be used when the user does not have a double puppet intent.
 func (pm *GhostMaster) SetupUserGhost(ctx context.Context, user *User) (*Ghost, error) {
-	fmt.Println("SetupUserGhost: ", user.MXID)
+	pm.log.Debug().Stringer("user_id", user.MXID).Msg("Setting up user ghost")
 	userGhost := pm.NewGhost(user.RemoteID, user.DisplayName, user.MXID.Localpart(), id.ContentURI{})
 
-	conf, ok := pm.userGhostConfig[user.MXID]
-	if !ok {
-		pm.userGhostConfig[user.MXID] = &userGhostConfig{}
-		conf = pm.userGhostConfig[user.MXID]
+	// the ghost may have been double puppeted before, so prefer the stored version
+	stored, err := pm.store.GetGhostByMXID(ctx, userGhost.MXID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user ghost: %w", err)
+	} else if stored != nil {
+		userGhost = pm.LoadGhost(stored)
 	}
 
-	conf.ghost = userGhost
+	pm.updateUserGhostConfig(user.MXID, func(conf *userGhostConfig) {
+		conf.ghost = userGhost
+	})
 
-	return conf.ghost, nil
+	return userGhost, nil
 }
 
 // SetupDoublePuppet creates a double puppet intent for the given user, if possible.
-// Double puppeting needs to be enabled for this to work
+// Double puppeting needs to be enabled for this to work.
+// The access token stored on the user is reused if it's still valid, and the new one gets persisted.
 func (pm *GhostMaster) SetupDoublePuppet(ctx context.Context, user *User) (*appservice.IntentAPI, error) {
-	c := pm.bridge.AS.Client(user.MXID)
-	newIntent, newAccessToken, err := pm.bridge.DoublePuppet.Setup(ctx, user.MXID, c.AccessToken, true)
+	log := pm.log.With().Stringer("user_id", user.MXID).Logger()
+	newIntent, newAccessToken, err := pm.bridge.DoublePuppet.Setup(ctx, user.MXID, user.GetAccessToken(), true)
 	if err != nil {
-		fmt.Println("Error setting up double puppet: ", err)
+		log.Warn().Err(err).Msg("Failed to set up double puppet")
 		return nil, err
 	}
 
-	user.AccessToken = newAccessToken
-	user.DoublePuppetIntent = newIntent
-
-	conf, ok := pm.userGhostConfig[user.MXID]
-	if !ok {
-		pm.userGhostConfig[user.MXID] = &userGhostConfig{}
-		conf = pm.userGhostConfig[user.MXID]
+	user.setDoublePuppet(newIntent, newAccessToken)
+	if err := pm.store.PutUser(ctx, user); err != nil {
+		log.Err(err).Msg("Failed to save double puppet access token")
 	}
 
-	conf.userMXID = user.MXID
-	conf.doublePuppetIntent = newIntent
+	pm.updateUserGhostConfig(user.MXID, func(conf *userGhostConfig) {
+		conf.doublePuppetIntent = newIntent
+	})
 
-	fmt.Println("double puppetting ok")
+	log.Debug().Msg("Double puppeting set up")
 
 	return newIntent, nil
 }
+
+// ClearDoublePuppet disables double puppeting for the given user and removes the stored access token.
+func (pm *GhostMaster) ClearDoublePuppet(ctx context.Context, user *User) {
+	user.setDoublePuppet(nil, "")
+	pm.updateUserGhostConfig(user.MXID, func(conf *userGhostConfig) {
+		conf.doublePuppetIntent = nil
+	})
+
+	if err := pm.store.PutUser(ctx, user); err != nil {
+		pm.log.Err(err).Stringer("user_id", user.MXID).Msg("Failed to save user after clearing double puppet")
+	}
+}
+
+// SwitchCustomMXID makes the given ghost act as the Matrix user with the given access token.
+// The access token is persisted, so the custom MXID is restored after restarting the bridge.
+func (pm *GhostMaster) SwitchCustomMXID(ctx context.Context, ghost *Ghost, accessToken string, userID id.UserID) error {
+	intent, newAccessToken, err := pm.bridge.DoublePuppet.Setup(ctx, userID, accessToken, false)
+	if err != nil {
+		return fmt.Errorf("failed to set up custom MXID: %w", err)
+	}
+
+	ghost.setCustomMXID(userID, newAccessToken, intent)
+	pm.log.Debug().Stringer("ghost_id", ghost.MXID).Stringer("custom_mxid", userID).Msg("Switched ghost to custom MXID")
+
+	return pm.store.PutGhost(ctx, ghost)
+}
+
+// StartCustomMXID sets up the intent for the stored custom MXID of the given ghost.
+func (pm *GhostMaster) StartCustomMXID(ctx context.Context, ghost *Ghost) error {
+	customMXID, accessToken := ghost.GetCustomMXID(), ghost.GetAccessToken()
+	intent, newAccessToken, err := pm.bridge.DoublePuppet.Setup(ctx, customMXID, accessToken, true)
+	if err != nil {
+		return err
+	}
+
+	ghost.setCustomMXID(customMXID, newAccessToken, intent)
+	if newAccessToken != accessToken {
+		return pm.store.PutGhost(ctx, ghost)
+	}
+
+	return nil
+}
+
+// ClearCustomMXID stops double puppeting the given ghost and removes the stored access token.
+func (pm *GhostMaster) ClearCustomMXID(ctx context.Context, ghost *Ghost) {
+	ghost.setCustomMXID("", "", nil)
+
+	if err := pm.store.PutGhost(ctx, ghost); err != nil {
+		pm.log.Err(err).Stringer("ghost_id", ghost.MXID).Msg("Failed to save ghost after clearing custom MXID")
+	}
+}
@@ -0,0 +1,81 @@
+package matrix
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/id"
+)
+
+type memoryGhostStore struct{}
+
+func (memoryGhostStore) GetGhostByMXID(ctx context.Context, userID id.UserID) (*Ghost, error) {
+	return nil, nil
+}
+
+func (memoryGhostStore) PutGhost(ctx context.Context, ghost *Ghost) error {
+	_, _ = ghost.GetCustomMXID(), ghost.GetAccessToken()
+	return nil
+}
+
+func (memoryGhostStore) PutUser(ctx context.Context, user *User) error {
+	_ = user.GetAccessToken()
+	return nil
+}
+
+func newTestBridge() *bridge.Bridge {
+	log := zerolog.Nop()
+	br := &bridge.Bridge{ZLog: &log}
+	br.Config.Homeserver.Domain = "example.com"
+
+	return br
+}
+
+// TestDoublePuppetStateRace is meant to be run with -race.
+func TestDoublePuppetStateRace(t *testing.T) {
+	br := newTestBridge()
+	pm := NewGhostMaster(br, "test", memoryGhostStore{})
+	rm := NewRoomManager(br, pm, nil)
+
+	ghost := &Ghost{MXID: "@test_ghost:example.com", CustomMXID: "@real:example.com", AccessToken: "token"}
+	user := &User{MXID: "@real:example.com", AccessToken: "token"}
+	room := &Room{MXID: "!room:example.com", Ghosts: []*Ghost{ghost}}
+
+	var wg sync.WaitGroup
+	run := func(fn func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				fn()
+			}
+		}()
+	}
+
+	run(func() { rm.LoadRoom(room) })
+	run(func() { pm.LoadGhost(ghost) })
+	run(func() { pm.LoadUser(user) })
+	run(func() { ghost.ClearCustomMXID() })
+	run(func() { user.ClearCustomMXID() })
+	run(func() {
+		_ = ghost.CustomIntent()
+		_ = ghost.GetCustomMXID()
+		_ = ghost.master()
+	})
+	run(func() {
+		_ = user.CustomIntent()
+		_ = user.GetAccessToken()
+	})
+	wg.Wait()
+
+	if ghost.master() != pm || user.master() != pm {
+		t.Fatal("expected the ghost and user to be loaded")
+	}
+	if ghost.GetCustomMXID() != "" || user.GetAccessToken() != "" {
+		t.Fatal("expected the double puppets to be cleared")
+	}
+}
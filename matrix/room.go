@@ -2,7 +2,8 @@ package matrix
 
 import (
 	"context"
-	"fmt"
+
+	"github.com/rs/zerolog"
 
 	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/bridge"
@@ -11,13 +12,31 @@ import (
 )
 
 var _ bridge.Portal = &Room{}
+var _ bridge.MembershipHandlingPortal = &Room{}
+var _ bridge.MetaHandlingPortal = &Room{}
+var _ bridge.ReadReceiptHandlingPortal = &Room{}
+var _ bridge.TypingPortal = &Room{}
 
 type RoomEventHandler interface {
 	HandleMatrixEvent(room *Room, user bridge.User, event *event.Event)
+	HandleMatrixReadReceipt(room *Room, user bridge.User, eventID id.EventID, receipt event.ReadReceipt)
+	HandleMatrixTyping(room *Room, userIDs []id.UserID)
 	HandleMarkEncrypted(room *Room)
-	UpdateBridgeInfo(ctx context.Context)
+	UpdateBridgeInfo(ctx context.Context, room *Room)
+	// TrackMatrixEvent is called when a Matrix event of the room is queued.
+	// If ok is false, the event is dropped, otherwise done is called once the event was handled.
+	TrackMatrixEvent(room *Room) (done func(), ok bool)
 }
 
+// GhostRole is the role of a ghost in a room on the remote network.
+type GhostRole string
+
+const (
+	GhostRoleMember    GhostRole = ""
+	GhostRoleModerator GhostRole = "moderator"
+	GhostRoleAdmin     GhostRole = "admin"
+)
+
 type Room struct {
 	RemotedID string    `json:"remoted_id,omitempty"`
 	MXID      id.RoomID `json:"mxid,omitempty"`
@@ -29,8 +48,11 @@ type Room struct {
 
 	BotIntent *appservice.IntentAPI `json:"-"`
 	Ghosts    []*Ghost              `json:"ghosts,omitempty"`
+	// GhostRoles are the roles of the ghosts in the room. Ghosts that aren't listed are members.
+	GhostRoles map[id.UserID]GhostRole `json:"ghost_roles,omitempty"`
 
 	roomEventHandler RoomEventHandler `json:"-"`
+	roomManager      *RoomManager     `json:"-"`
 }
 
 func NewRoom(name string, topic string, botIntent *appservice.IntentAPI, ghosts ...*Ghost) *Room {
@@ -56,15 +78,31 @@ func (p *Room) GhostUserIDs() []id.UserID {
 	return ghostIDs
 }
 
+// GhostRole returns the role of the given ghost in the room.
+func (p *Room) GhostRole(userID id.UserID) GhostRole {
+	return p.GhostRoles[userID]
+}
+
+// SetGhostRole sets the role of the given ghost in the room.
+func (p *Room) SetGhostRole(userID id.UserID, role GhostRole) {
+	if role == GhostRoleMember {
+		delete(p.GhostRoles, userID)
+		return
+	}
+
+	if p.GhostRoles == nil {
+		p.GhostRoles = make(map[id.UserID]GhostRole)
+	}
+	p.GhostRoles[userID] = role
+}
+
 // IsEncrypted implements bridge.Portal.
 func (p *Room) IsEncrypted() bool {
-	fmt.Println("[IsEncrypted]?? ", p.MXID.String(), p.Encrypted)
 	return p.Encrypted
 }
 
 // IsPrivateChat implements bridge.Portal.
 func (p *Room) IsPrivateChat() bool {
-	fmt.Println("[IsPrivateChat] ", p.MXID.String(), p.PrivateChat)
 	return p.PrivateChat
 }
 
@@ -80,33 +118,105 @@ func (p *Room) MainIntent() *appservice.IntentAPI {
 	return p.BotIntent
 }
 
+// log returns the logger of the room manager, or the default context logger if the room doesn't have one.
+func (p *Room) log() *zerolog.Logger {
+	if p.roomManager != nil {
+		return &p.roomManager.log
+	}
+
+	return zerolog.Ctx(context.Background())
+}
+
 // MarkEncrypted implements bridge.Portal.
 func (p *Room) MarkEncrypted() {
 	if p.roomEventHandler != nil {
-		p.roomEventHandler.HandleMarkEncrypted(p)
 		p.Encrypted = true
+		p.roomEventHandler.HandleMarkEncrypted(p)
 		return
 	}
 
-	fmt.Println("[MarkEncrypted] called but not bound")
+	p.log().Warn().Stringer("room_id", p.MXID).Msg("MarkEncrypted called but room is not bound")
 }
 
 // ReceiveMatrixEvent implements bridge.Portal.
+// The event is handled on the event queue of the room, after all events that were received before it.
 func (p *Room) ReceiveMatrixEvent(user bridge.User, evt *event.Event) {
 	if p.roomEventHandler != nil {
-		p.roomEventHandler.HandleMatrixEvent(p, user, evt)
+		p.queue(func() {
+			p.roomEventHandler.HandleMatrixEvent(p, user, evt)
+		})
 		return
 	}
 
-	fmt.Println("[ReceiveMatrixEvent] called but not bound")
+	p.log().Warn().Stringer("room_id", p.MXID).Msg("ReceiveMatrixEvent called but room is not bound")
+}
+
+// HandleMatrixLeave implements bridge.MembershipHandlingPortal.
+func (p *Room) HandleMatrixLeave(sender bridge.User, evt *event.Event) {
+	p.ReceiveMatrixEvent(sender, evt)
+}
+
+// HandleMatrixKick implements bridge.MembershipHandlingPortal.
+func (p *Room) HandleMatrixKick(sender bridge.User, ghost bridge.Ghost, evt *event.Event) {
+	p.ReceiveMatrixEvent(sender, evt)
+}
+
+// HandleMatrixInvite implements bridge.MembershipHandlingPortal.
+func (p *Room) HandleMatrixInvite(sender bridge.User, ghost bridge.Ghost, evt *event.Event) {
+	p.ReceiveMatrixEvent(sender, evt)
+}
+
+// HandleMatrixMeta implements bridge.MetaHandlingPortal.
+func (p *Room) HandleMatrixMeta(sender bridge.User, evt *event.Event) {
+	p.ReceiveMatrixEvent(sender, evt)
+}
+
+// HandleMatrixReadReceipt implements bridge.ReadReceiptHandlingPortal.
+func (p *Room) HandleMatrixReadReceipt(sender bridge.User, eventID id.EventID, receipt event.ReadReceipt) {
+	if p.roomEventHandler != nil {
+		p.queue(func() {
+			p.roomEventHandler.HandleMatrixReadReceipt(p, sender, eventID, receipt)
+		})
+		return
+	}
+
+	p.log().Warn().Stringer("room_id", p.MXID).Msg("HandleMatrixReadReceipt called but room is not bound")
+}
+
+// HandleMatrixTyping implements bridge.TypingPortal.
+func (p *Room) HandleMatrixTyping(userIDs []id.UserID) {
+	if p.roomEventHandler != nil {
+		p.roomEventHandler.HandleMatrixTyping(p, userIDs)
+		return
+	}
+
+	p.log().Warn().Stringer("room_id", p.MXID).Msg("HandleMatrixTyping called but room is not bound")
 }
 
 // UpdateBridgeInfo implements bridge.Portal.
 func (p *Room) UpdateBridgeInfo(ctx context.Context) {
 	if p.roomEventHandler != nil {
-		p.roomEventHandler.UpdateBridgeInfo(ctx)
+		p.roomEventHandler.UpdateBridgeInfo(ctx, p)
+		return
+	}
+
+	zerolog.Ctx(ctx).Warn().Stringer("room_id", p.MXID).Msg("UpdateBridgeInfo called but room is not bound")
+}
+
+// EventQueueStats returns the state of the Matrix event queue of the room.
+func (p *Room) EventQueueStats() EventQueueStats {
+	if p.roomManager == nil {
+		return EventQueueStats{}
+	}
+
+	return p.roomManager.EventQueueStats()[p.MXID]
+}
+
+func (p *Room) queue(handle func()) {
+	if p.roomManager == nil {
+		handle()
 		return
 	}
 
-	fmt.Println("[UpdateBridgeInfo] called but not bound")
+	p.roomManager.queueRoomEvent(p, handle)
 }
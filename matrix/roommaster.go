@@ -3,8 +3,10 @@ package matrix
 import (
 	"context"
 	"fmt"
-	"io"
-	"net/http"
+	"sync"
+
+	"github.com/dvcrn/matrix-bridgekit/media"
+	"github.com/rs/zerolog"
 
 	"maunium.net/go/mautrix/appservice"
 
@@ -14,10 +16,26 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
+// RoomManager is safe for concurrent use.
 type RoomManager struct {
 	bridge           *bridge.Bridge
 	ghostMaster      *GhostMaster
 	roomEventHandler RoomEventHandler
+	log              zerolog.Logger
+
+	// MediaFetcher downloads room avatars. Defaults to media.DefaultFetcher.
+	MediaFetcher *media.Fetcher
+	// PowerLevelPolicy is used for the power levels of personal spaces. Defaults to DefaultPowerLevelPolicy.
+	PowerLevelPolicy PowerLevelPolicy
+
+	// EventQueueSize is the number of Matrix events that can wait per room. Defaults to DefaultEventQueueSize.
+	EventQueueSize int
+
+	queuesLock sync.Mutex
+	queues     map[id.RoomID]*eventQueue
+
+	// loadLock serialises LoadRoom, as the same room may be loaded from several goroutines
+	loadLock sync.Mutex
 }
 
 func NewRoomManager(bridge *bridge.Bridge, gm *GhostMaster, roomEventHandler RoomEventHandler) *RoomManager {
@@ -25,9 +43,14 @@ func NewRoomManager(bridge *bridge.Bridge, gm *GhostMaster, roomEventHandler Roo
 		bridge:           bridge,
 		ghostMaster:      gm,
 		roomEventHandler: roomEventHandler,
+		log:              bridge.ZLog.With().Str("component", "room manager").Logger(),
+		queues:           make(map[id.RoomID]*eventQueue),
+		MediaFetcher:     media.DefaultFetcher(),
+		PowerLevelPolicy: DefaultPowerLevelPolicy(),
 	}
 }
 
+// NewRoom creates a room that isn't bridged yet. Set RemotedID before creating or saving the room, as rooms are stored by it.
 func (rm *RoomManager) NewRoom(name string, topic string, ghosts ...*Ghost) *Room {
 	return &Room{
 		RemotedID:   "",
@@ -40,6 +63,7 @@ func (rm *RoomManager) NewRoom(name string, topic string, ghosts ...*Ghost) *Roo
 		Ghosts:      ghosts,
 
 		roomEventHandler: rm.roomEventHandler,
+		roomManager:      rm,
 	}
 }
 
@@ -64,8 +88,8 @@ func (rm *RoomManager) CreatePersonalSpace(ctx context.Context, user *User, name
 		BeeperAutoJoinInvites: true,
 		PowerLevelOverride: &event.PowerLevelsEventContent{
 			Users: map[id.UserID]int{
-				rm.bridge.Bot.UserID: 9001,
-				user.MXID:            50,
+				rm.bridge.Bot.UserID: rm.PowerLevelPolicy.Bot,
+				user.MXID:            rm.PowerLevelPolicy.User,
 			},
 		},
 	})
@@ -75,7 +99,7 @@ func (rm *RoomManager) CreatePersonalSpace(ctx context.Context, user *User, name
 	}
 
 	if err := rm.AddUserToRoom(ctx, resp.RoomID, user); err != nil {
-		fmt.Println("Err adding user to room: ", err)
+		rm.log.Err(err).Stringer("room_id", resp.RoomID).Stringer("user_id", user.MXID).Msg("Failed to add user to personal space")
 	}
 
 	return resp, nil
@@ -83,7 +107,7 @@ func (rm *RoomManager) CreatePersonalSpace(ctx context.Context, user *User, name
 
 // AddRoomToUserSpace adds a room to the user's space, effectively making it a child of the space
 func (rm *RoomManager) AddRoomToUserSpace(ctx context.Context, spaceID id.RoomID, room *Room) error {
-	fmt.Println("[AddRoomToUserSpace] ", room.Name)
+	rm.log.Debug().Stringer("space_id", spaceID).Stringer("room_id", room.MXID).Msg("Adding room to space")
 	_, err := rm.bridge.Bot.SendStateEvent(ctx, spaceID, event.StateSpaceChild, room.MXID.String(), &event.SpaceChildEventContent{
 		Via: []string{rm.bridge.Config.Homeserver.Domain},
 	})
@@ -98,14 +122,14 @@ func (rm *RoomManager) AddRoomToUserSpace(ctx context.Context, spaceID id.RoomID
 // it ensures the double puppet is joined to the room.
 func (rm *RoomManager) AddUserToRoom(ctx context.Context, roomID id.RoomID, user *User) error {
 	if _, err := rm.bridge.Bot.InviteUser(ctx, roomID, &mautrix.ReqInviteUser{UserID: user.MXID}); err != nil {
-		fmt.Println("could not InviteUser to SpaceRoom :of ", err.Error())
+		rm.log.Err(err).Stringer("room_id", roomID).Stringer("user_id", user.MXID).Msg("Failed to invite user to room")
 		return err
 	}
 
-	if user.DoublePuppetIntent != nil {
-		err := user.DoublePuppetIntent.EnsureJoined(ctx, roomID, appservice.EnsureJoinedParams{IgnoreCache: true})
+	if intent := user.CustomIntent(); intent != nil {
+		err := intent.EnsureJoined(ctx, roomID, appservice.EnsureJoinedParams{IgnoreCache: true})
 		if err != nil {
-			fmt.Println("could not call 'ensurejoined' ", err.Error())
+			rm.log.Err(err).Stringer("room_id", roomID).Stringer("user_id", user.MXID).Msg("Failed to join double puppet to room")
 		}
 
 		return err
@@ -137,44 +161,79 @@ func (rm *RoomManager) InsertSetRoomAvatarEvent(ctx context.Context, room *Room,
 // UploadRoomAvatar downloads the avatar from the provided URL, uploads it to Matrix, and sets it as the room's avatar.
 // Returns the Matrix content URI of the uploaded avatar.
 func (rm *RoomManager) UploadRoomAvatar(ctx context.Context, room *Room, intent *appservice.IntentAPI, url string) (id.ContentURI, error) {
-	bot := rm.bridge.AS.BotClient()
-
-	getResp, err := http.DefaultClient.Get(url)
-	if err != nil {
-		return id.ContentURI{}, fmt.Errorf("failed to download avatar: %w", err)
-	}
-
-	data, err := io.ReadAll(getResp.Body)
-	_ = getResp.Body.Close()
+	avatar, err := fetchAvatar(ctx, rm.bridge, rm.MediaFetcher, url)
 	if err != nil {
-		return id.ContentURI{}, fmt.Errorf("failed to read avatar bytes: %w", err)
+		return id.ContentURI{}, err
 	}
 
-	// upload to matrix
-	resp, err := bot.UploadBytes(ctx, data, "image/png")
+	contentURI, err := uploadAvatar(ctx, rm.bridge, avatar)
 	if err != nil {
-		return id.ContentURI{}, fmt.Errorf("failed to upload avatar to Matrix: %w", err)
+		return id.ContentURI{}, err
 	}
 
-	err = rm.SetRoomAvatar(ctx, room, intent, resp.ContentURI)
+	err = rm.SetRoomAvatar(ctx, room, intent, contentURI)
 
-	return resp.ContentURI, err
+	return contentURI, err
 }
 
 // LoadRoom loads the bot intent for the given room and loads the ghost intents for any ghosts in the room.
 // This method is used when a room is freshly created and has no intent information attached yet
+// Fields that are already set are left untouched, so loading a room again is safe.
 func (rm *RoomManager) LoadRoom(room *Room) {
+	rm.loadLock.Lock()
+	defer rm.loadLock.Unlock()
+
 	if room.BotIntent == nil {
 		room.BotIntent = rm.bridge.Bot
 	}
 
 	for _, ghost := range room.Ghosts {
-		rm.ghostMaster.LoadGhost(ghost)
+		if ghost.master() == nil {
+			rm.ghostMaster.LoadGhost(ghost)
+		}
 	}
 
 	if room.roomEventHandler == nil {
 		room.roomEventHandler = rm.roomEventHandler
 	}
+	if room.roomManager == nil {
+		room.roomManager = rm
+	}
+}
+
+// SyncGhostPowerLevels brings the power levels of the ghosts in the room in line with their roles.
+// Only ghosts whose level differs are changed, so levels that were set by users and the level of the bot are kept.
+// In read-only rooms, ghosts keep a level that is high enough to send messages.
+// Returns whether the power levels changed.
+func (rm *RoomManager) SyncGhostPowerLevels(ctx context.Context, room *Room, policy PowerLevelPolicy) (bool, error) {
+	powerLevels, err := rm.bridge.Bot.PowerLevels(ctx, room.MXID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get power levels: %w", err)
+	}
+
+	readOnly := powerLevels.GetEventLevel(event.EventMessage) >= policy.ReadOnly
+	changed := false
+	for _, ghost := range room.Ghosts {
+		level := policy.RoleLevel(room.GhostRole(ghost.MXID))
+		if readOnly {
+			level = max(level, policy.ReadOnlyGhost)
+		}
+
+		if powerLevels.EnsureUserLevelAs(rm.bridge.Bot.UserID, ghost.MXID, level) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	rm.log.Debug().Stringer("room_id", room.MXID).Msg("Updating power levels of ghosts")
+	if _, err := rm.bridge.Bot.SetPowerLevels(ctx, room.MXID, powerLevels); err != nil {
+		return false, fmt.Errorf("failed to set power levels: %w", err)
+	}
+
+	return true, nil
 }
 
 func (rm *RoomManager) EncryptRoom(ctx context.Context, room *Room) {
@@ -0,0 +1,207 @@
+package matrix
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// DefaultEventQueueSize is the number of Matrix events that can wait per room before receiving new ones blocks.
+const DefaultEventQueueSize = 128
+
+// slowEventLatency is how long an event may wait in the queue before it gets logged as slow.
+const slowEventLatency = 5 * time.Second
+
+// eventQueueIdleTimeout is how long the queue of a room waits for new events before it's torn down.
+const eventQueueIdleTimeout = time.Minute
+
+// EventQueueStats describes the Matrix event queue of a room.
+type EventQueueStats struct {
+	// Depth is the number of events waiting to be handled.
+	Depth int
+	// Processed is the number of events handled so far.
+	Processed uint64
+	// LastLatency is how long the last handled event waited in the queue.
+	LastLatency time.Duration
+	// MaxLatency is the longest any event waited in the queue.
+	MaxLatency time.Duration
+}
+
+type queuedEvent struct {
+	handle   func()
+	done     func()
+	queuedAt time.Time
+}
+
+// eventQueue handles the Matrix events of a single room one after the other on its own goroutine.
+// The goroutine ends when the queue was idle for eventQueueIdleTimeout, or when the queue is stopped.
+type eventQueue struct {
+	roomID id.RoomID
+	ch     chan queuedEvent
+	stop   chan struct{}
+	log    zerolog.Logger
+	rm     *RoomManager
+
+	// pending counts the events that were handed to the queue but not received by the loop yet.
+	// It's increased with the queuesLock of the RoomManager held, so that an idle queue isn't removed while an event is on its way.
+	pending atomic.Int64
+
+	processed   atomic.Uint64
+	lastLatency atomic.Int64
+	maxLatency  atomic.Int64
+}
+
+func newEventQueue(rm *RoomManager, roomID id.RoomID, size int) *eventQueue {
+	q := &eventQueue{
+		roomID: roomID,
+		ch:     make(chan queuedEvent, size),
+		stop:   make(chan struct{}),
+		log:    rm.log.With().Stringer("room_id", roomID).Logger(),
+		rm:     rm,
+	}
+	go q.loop()
+
+	return q
+}
+
+func (q *eventQueue) push(evt queuedEvent) {
+	select {
+	case q.ch <- evt:
+		return
+	default:
+	}
+
+	q.log.Warn().Int("queue_size", cap(q.ch)).Msg("Event queue is full, waiting for room to catch up")
+	select {
+	case q.ch <- evt:
+	case <-q.stop:
+		q.pending.Add(-1)
+		if evt.done != nil {
+			evt.done()
+		}
+	}
+}
+
+func (q *eventQueue) loop() {
+	idle := time.NewTimer(eventQueueIdleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case evt := <-q.ch:
+			q.pending.Add(-1)
+			q.handle(evt)
+			idle.Reset(eventQueueIdleTimeout)
+		case <-idle.C:
+			if q.rm.removeIdleQueue(q) {
+				return
+			}
+			idle.Reset(eventQueueIdleTimeout)
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+func (q *eventQueue) handle(evt queuedEvent) {
+	latency := time.Since(evt.queuedAt)
+	q.lastLatency.Store(int64(latency))
+	if int64(latency) > q.maxLatency.Load() {
+		q.maxLatency.Store(int64(latency))
+	}
+	if latency > slowEventLatency {
+		q.log.Warn().Dur("latency", latency).Int("depth", len(q.ch)).Msg("Matrix event waited long in queue")
+	}
+
+	q.run(evt)
+	q.processed.Add(1)
+}
+
+func (q *eventQueue) run(evt queuedEvent) {
+	defer func() {
+		if evt.done != nil {
+			evt.done()
+		}
+		if err := recover(); err != nil {
+			q.log.Error().Interface(zerolog.ErrorFieldName, err).Msg("Panic while handling Matrix event")
+		}
+	}()
+
+	evt.handle()
+}
+
+func (q *eventQueue) stats() EventQueueStats {
+	return EventQueueStats{
+		Depth:       len(q.ch),
+		Processed:   q.processed.Load(),
+		LastLatency: time.Duration(q.lastLatency.Load()),
+		MaxLatency:  time.Duration(q.maxLatency.Load()),
+	}
+}
+
+// queueRoomEvent queues the handler of a Matrix event of the room. Events of the same room are handled in order,
+// while different rooms are handled in parallel.
+func (rm *RoomManager) queueRoomEvent(room *Room, handle func()) {
+	done, ok := rm.roomEventHandler.TrackMatrixEvent(room)
+	if !ok {
+		return
+	}
+
+	rm.queuesLock.Lock()
+	q, exists := rm.queues[room.MXID]
+	if !exists {
+		size := rm.EventQueueSize
+		if size <= 0 {
+			size = DefaultEventQueueSize
+		}
+		q = newEventQueue(rm, room.MXID, size)
+		rm.queues[room.MXID] = q
+	}
+	q.pending.Add(1)
+	rm.queuesLock.Unlock()
+
+	q.push(queuedEvent{handle: handle, done: done, queuedAt: time.Now()})
+}
+
+// removeIdleQueue removes the queue if no events are on their way to it. Returns whether it was removed.
+func (rm *RoomManager) removeIdleQueue(q *eventQueue) bool {
+	rm.queuesLock.Lock()
+	defer rm.queuesLock.Unlock()
+
+	if q.pending.Load() > 0 || len(q.ch) > 0 {
+		return false
+	}
+	if rm.queues[q.roomID] == q {
+		delete(rm.queues, q.roomID)
+	}
+
+	return true
+}
+
+// StopEventQueues stops the Matrix event queues of all rooms. Events that are still queued aren't handled.
+// Queues are started again when new events arrive.
+func (rm *RoomManager) StopEventQueues() {
+	rm.queuesLock.Lock()
+	defer rm.queuesLock.Unlock()
+
+	for roomID, q := range rm.queues {
+		close(q.stop)
+		delete(rm.queues, roomID)
+	}
+}
+
+// EventQueueStats returns the state of the Matrix event queue of every room that received events recently.
+func (rm *RoomManager) EventQueueStats() map[id.RoomID]EventQueueStats {
+	rm.queuesLock.Lock()
+	defer rm.queuesLock.Unlock()
+
+	stats := make(map[id.RoomID]EventQueueStats, len(rm.queues))
+	for roomID, q := range rm.queues {
+		stats[roomID] = q.stats()
+	}
+
+	return stats
+}
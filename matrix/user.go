@@ -1,8 +1,9 @@
 package matrix
 
 import (
+	"context"
 	"errors"
-	"fmt"
+	"sync"
 
 	"maunium.net/go/mautrix/appservice"
 
@@ -17,68 +18,165 @@ var _ bridge.DoublePuppet = (*User)(nil)
 var _ commands.CommandingUser = (*User)(nil)
 
 type SetManagementRoomHandler func(*User, id.RoomID)
+type IsLoggedInHandler func(*User) bool
+
+// LoginState is the state of the user's login on the remote network.
+type LoginState string
+
+const (
+	// LoginStateUnknown means the login state was never set. Users in this state are considered logged in.
+	LoginStateUnknown        LoginState = ""
+	LoginStateLoggedIn       LoginState = "logged_in"
+	LoginStateLoggedOut      LoginState = "logged_out"
+	LoginStateBadCredentials LoginState = "bad_credentials"
+)
 
 type User struct {
 	// ID is the ID of the user in the Matrix homeserver.
-	MXID               id.UserID                    `json:"mxid,omitempty"`
-	RemoteID           string                       `json:"remote_id,omitempty"`
-	RemoteName         string                       `json:"remote_name,omitempty"`
-	DisplayName        string                       `json:"display_name,omitempty"`
-	PermissionLevel    bridgeconfig.PermissionLevel `json:"permission_level,omitempty"`
-	ManagementRoomID   id.RoomID                    `json:"management_room_id,omitempty"`
-	BridgeState        *bridge.BridgeStateQueue     `json:"-"`
-	DoublePuppetIntent *appservice.IntentAPI        `json:"-"`
-	AccessToken        string                       `json:"access_token,omitempty"`
-
+	MXID             id.UserID                    `json:"mxid,omitempty"`
+	RemoteID         string                       `json:"remote_id,omitempty"`
+	RemoteName       string                       `json:"remote_name,omitempty"`
+	DisplayName      string                       `json:"display_name,omitempty"`
+	PermissionLevel  bridgeconfig.PermissionLevel `json:"permission_level,omitempty"`
+	ManagementRoomID id.RoomID                    `json:"management_room_id,omitempty"`
+	BridgeState      *bridge.BridgeStateQueue     `json:"-"`
+	// DoublePuppetIntent and AccessToken are set up by the GhostMaster. Use CustomIntent and GetAccessToken to read them.
+	DoublePuppetIntent *appservice.IntentAPI `json:"-"`
+	AccessToken        string                `json:"access_token,omitempty"`
+	LoginState         LoginState            `json:"login_state,omitempty"`
+	// Credentials are the remote credentials of the user, as returned by the login flow of the connector.
+	Credentials map[string]string `json:"credentials,omitempty"`
+
+	// CommandState is the ongoing command of the user. Use GetCommandState and SetCommandState to access it concurrently.
 	CommandState             *commands.CommandState   `json:"-"`
 	SetManagementRoomHandler SetManagementRoomHandler `json:"-"`
+	IsLoggedInHandler        IsLoggedInHandler        `json:"-"`
+
+	ghostMaster *GhostMaster `json:"-"`
+
+	commandStateLock sync.Mutex
+	// doublePuppetLock guards DoublePuppetIntent, AccessToken and ghostMaster, which change while the user is shared
+	doublePuppetLock sync.RWMutex
 }
 
 // GetCommandState implements commands.CommandingUser.
 func (u *User) GetCommandState() *commands.CommandState {
-	fmt.Println("GetCommandState ", u.CommandState)
+	u.commandStateLock.Lock()
+	defer u.commandStateLock.Unlock()
+
 	return u.CommandState
 }
 
 // SetCommandState implements commands.CommandingUser.
 func (u *User) SetCommandState(c *commands.CommandState) {
-	fmt.Println("SetCommandState ", c)
+	u.commandStateLock.Lock()
+	defer u.commandStateLock.Unlock()
+
 	u.CommandState = c
 }
 
 // -- double puppet
 func (u *User) CustomIntent() *appservice.IntentAPI {
+	u.doublePuppetLock.RLock()
+	defer u.doublePuppetLock.RUnlock()
+
 	return u.DoublePuppetIntent
 }
 
+// GetAccessToken returns the access token of the double puppet.
+func (u *User) GetAccessToken() string {
+	u.doublePuppetLock.RLock()
+	defer u.doublePuppetLock.RUnlock()
+
+	return u.AccessToken
+}
+
+// setDoublePuppet replaces the double puppet intent and access token of the user.
+func (u *User) setDoublePuppet(intent *appservice.IntentAPI, accessToken string) {
+	u.doublePuppetLock.Lock()
+	defer u.doublePuppetLock.Unlock()
+
+	u.DoublePuppetIntent = intent
+	u.AccessToken = accessToken
+}
+
+// master returns the GhostMaster that loaded the user, or nil if it isn't loaded.
+func (u *User) master() *GhostMaster {
+	u.doublePuppetLock.RLock()
+	defer u.doublePuppetLock.RUnlock()
+
+	return u.ghostMaster
+}
+
+// SwitchCustomMXID implements bridge.DoublePuppet, see SwitchCustomMXIDContext.
 func (u *User) SwitchCustomMXID(accessToken string, userID id.UserID) error {
-	fmt.Println("[SwitchCustomMXID] ", userID, accessToken)
+	return u.SwitchCustomMXIDContext(context.Background(), accessToken, userID)
+}
+
+// SwitchCustomMXIDContext sets up double puppeting for the user with the given access token.
+func (u *User) SwitchCustomMXIDContext(ctx context.Context, accessToken string, userID id.UserID) error {
 	if userID != u.MXID {
 		return errors.New("mismatching mxid")
 	}
 
-	u.DoublePuppetIntent = nil
-	u.AccessToken = accessToken
+	u.setDoublePuppet(nil, accessToken)
+	pm := u.master()
+	if pm == nil {
+		return nil
+	}
 
-	return nil
+	_, err := pm.SetupDoublePuppet(ctx, u)
+	return err
 }
 
+// ClearCustomMXID implements bridge.DoublePuppet, see ClearCustomMXIDContext.
 func (u *User) ClearCustomMXID() {
-	u.DoublePuppetIntent = nil
-	u.AccessToken = ""
+	u.ClearCustomMXIDContext(context.Background())
+}
+
+// ClearCustomMXIDContext stops double puppeting the user.
+func (u *User) ClearCustomMXIDContext(ctx context.Context) {
+	if pm := u.master(); pm != nil {
+		pm.ClearDoublePuppet(ctx, u)
+		return
+	}
+
+	u.setDoublePuppet(nil, "")
 }
 
 // -- end double puppet
 
 // GetIDoublePuppet implements bridge.User.
+// Returns the user ghost if it was switched to the user's real MXID instead, and nil if double puppeting isn't set up.
 func (u *User) GetIDoublePuppet() bridge.DoublePuppet {
-	panic("GetIDoublePuppet unimplemented")
+	if u.CustomIntent() != nil {
+		return u
+	}
+
+	if pm := u.master(); pm != nil {
+		if ghost := pm.loadedUserGhost(u); ghost != nil && ghost.CustomIntent() != nil {
+			return ghost
+		}
+	}
+
+	return nil
 }
 
 // GetIGhost implements bridge.User.
+// Returns the ghost that represents the user when double puppeting isn't available.
+// Use GhostMaster.GetUserGhost to pass a context.
 func (u *User) GetIGhost() bridge.Ghost {
-	panic("GetIGhost " + u.DisplayName + "  unimplemented")
-	return nil
+	pm := u.master()
+	if pm == nil {
+		return nil
+	}
+
+	ghost, err := pm.GetUserGhost(context.Background(), u)
+	if err != nil || ghost == nil {
+		return nil
+	}
+
+	return ghost
 }
 
 // GetMXID implements bridge.User.
@@ -88,25 +186,26 @@ func (u *User) GetMXID() id.UserID {
 
 // GetManagementRoomID implements bridge.User.
 func (u *User) GetManagementRoomID() id.RoomID {
-	fmt.Println("[GetManagementRoomID] ", u.ManagementRoomID)
 	return u.ManagementRoomID
 }
 
 // GetPermissionLevel implements bridge.User.
 func (u *User) GetPermissionLevel() bridgeconfig.PermissionLevel {
-	fmt.Println("[GetPermissionLevel "+u.DisplayName+"] ", u.PermissionLevel)
 	return u.PermissionLevel
 }
 
 // IsLoggedIn implements bridge.User.
+// The connector decides if it implements bridgekit.LoginChecker, otherwise the LoginState of the user is used.
 func (u *User) IsLoggedIn() bool {
-	fmt.Println("IsLoggedIn unimplemented")
-	return true
+	if u.IsLoggedInHandler != nil {
+		return u.IsLoggedInHandler(u)
+	}
+
+	return u.LoginState == LoginStateUnknown || u.LoginState == LoginStateLoggedIn
 }
 
 // SetManagementRoom implements bridge.User.
 func (u *User) SetManagementRoom(rid id.RoomID) {
-	fmt.Println("[SetManagementRoom] ", rid.String())
 	u.SetManagementRoomHandler(u, rid)
 	u.ManagementRoomID = rid
 }
@@ -114,11 +213,9 @@ func (u *User) SetManagementRoom(rid id.RoomID) {
 // for bridge state
 
 func (u *User) GetRemoteID() string {
-	fmt.Println("[GetRemoteID] ", u.RemoteID)
 	return u.RemoteID
 }
 
 func (u *User) GetRemoteName() string {
-	fmt.Println("[GetRemoteName] ", u.RemoteName)
 	return u.RemoteName
 }
@@ -0,0 +1,141 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrTooLarge is returned when remote media is larger than the maximum size of the fetcher.
+	ErrTooLarge = errors.New("media is too large")
+	// ErrUnexpectedStatus is returned when the remote server doesn't respond with a 2xx status code.
+	ErrUnexpectedStatus = errors.New("unexpected status code")
+	// ErrUnexpectedContentType is returned when remote media isn't of any of the expected types.
+	ErrUnexpectedContentType = errors.New("unexpected content type")
+)
+
+// FetchConfig configures a Fetcher. It can be embedded in the bridge config, zero values are replaced with the defaults.
+type FetchConfig struct {
+	// Timeout is the time limit for a whole download. Defaults to 30 seconds.
+	Timeout time.Duration `yaml:"timeout"`
+	// Proxy is the URL of an HTTP or SOCKS5 proxy to download through. Defaults to the proxy from the environment.
+	Proxy string `yaml:"proxy"`
+	// MaxSize is the maximum size in bytes of a download. Defaults to 50 MiB.
+	MaxSize int64 `yaml:"max_size"`
+	// UserAgent is sent with every request. Defaults to the Go user agent.
+	UserAgent string `yaml:"user_agent"`
+	// Headers are sent with every request.
+	Headers map[string]string `yaml:"headers"`
+}
+
+// FetchedMedia is a file that was downloaded from a remote server.
+type FetchedMedia struct {
+	Data []byte
+	// MimeType is the type that the server sent, or the sniffed type if the server didn't send a usable one.
+	MimeType string
+}
+
+// Fetcher downloads remote media, like avatars and attachments, with a timeout and size limit.
+type Fetcher struct {
+	client *http.Client
+	config FetchConfig
+
+	// PrepareRequest is called with every request before it's sent, for example to add authentication headers or cookies.
+	PrepareRequest func(req *http.Request)
+}
+
+// NewFetcher creates a new Fetcher with the given config.
+func NewFetcher(config FetchConfig) (*Fetcher, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = 30 * time.Second
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = 50 * 1024 * 1024
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.Proxy != "" {
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse proxy URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &Fetcher{
+		client: &http.Client{Timeout: config.Timeout, Transport: transport},
+		config: config,
+	}, nil
+}
+
+// DefaultFetcher returns a Fetcher with the default config.
+func DefaultFetcher() *Fetcher {
+	fetcher, _ := NewFetcher(FetchConfig{})
+	return fetcher
+}
+
+// Fetch downloads the file at the given URL. If any types are given, the file has to match one of them,
+// either exactly like "image/png" or by prefix like "image/".
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string, types ...string) (*FetchedMedia, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %w", err)
+	}
+
+	if f.config.UserAgent != "" {
+		req.Header.Set("User-Agent", f.config.UserAgent)
+	}
+	for key, value := range f.config.Headers {
+		req.Header.Set(key, value)
+	}
+	if f.PrepareRequest != nil {
+		f.PrepareRequest(req)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download media: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%w %d", ErrUnexpectedStatus, resp.StatusCode)
+	} else if resp.ContentLength > f.config.MaxSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTooLarge, resp.ContentLength)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, f.config.MaxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read media: %w", err)
+	} else if int64(len(data)) > f.config.MaxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, f.config.MaxSize)
+	}
+
+	mimeType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = DetectMimeType(data, req.URL.Path)
+	}
+
+	if len(types) > 0 && !matchesType(mimeType, types) {
+		return nil, fmt.Errorf("%w %s", ErrUnexpectedContentType, mimeType)
+	}
+
+	return &FetchedMedia{Data: data, MimeType: mimeType}, nil
+}
+
+func matchesType(mimeType string, types []string) bool {
+	for _, t := range types {
+		if mimeType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mimeType, t)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,142 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+// ImageSize returns the dimensions of the given image without decoding all of it.
+func ImageSize(data []byte) (width, height int, err error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return cfg.Width, cfg.Height, nil
+}
+
+// Thumbnail decodes the given image and returns a JPEG thumbnail that fits within maxSize x maxSize.
+func Thumbnail(data []byte, maxSize int) ([]byte, int, int, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	thumb := ScaleDown(img, maxSize)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, 0, 0, err
+	}
+
+	return buf.Bytes(), thumb.Bounds().Dx(), thumb.Bounds().Dy(), nil
+}
+
+// ScaleDown scales the image so that it fits within maxSize x maxSize, keeping the aspect ratio.
+// Images that already fit are returned as-is.
+func ScaleDown(img image.Image, maxSize int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSize && height <= maxSize {
+		return img
+	}
+
+	newWidth, newHeight := maxSize, maxSize
+	if width > height {
+		newHeight = max(1, height*maxSize/width)
+	} else {
+		newWidth = max(1, width*maxSize/height)
+	}
+
+	// nearest neighbour is good enough for thumbnails and avatars
+	scaled := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	for y := 0; y < newHeight; y++ {
+		srcY := bounds.Min.Y + y*height/newHeight
+		for x := 0; x < newWidth; x++ {
+			srcX := bounds.Min.X + x*width/newWidth
+			scaled.Set(x, y, img.At(srcX, srcY))
+		}
+	}
+
+	return scaled
+}
+
+// DefaultMaxAvatarSize is the maximum width and height of avatars prepared with PrepareAvatar.
+const DefaultMaxAvatarSize = 1024
+
+// avatarTypes are the image types that Matrix clients can display as avatars, so they don't need converting.
+var avatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// ErrUnsupportedImage is returned by PrepareAvatar for files that aren't images in a usable format.
+var ErrUnsupportedImage = errors.New("unsupported image format")
+
+// Avatar is an image that is ready to be uploaded as an avatar.
+type Avatar struct {
+	Data     []byte
+	MimeType string
+	// Width and Height are zero if the image couldn't be decoded, for example because no decoder is registered for it.
+	Width  int
+	Height int
+}
+
+// PrepareAvatar sniffs the real type of the given image and makes it usable as an avatar:
+// images larger than maxSize x maxSize are scaled down, and decodable images in a type that clients can't display
+// are converted to PNG. Register more decoders, like golang.org/x/image/webp, to support more formats.
+//
+// Animated GIFs are kept as-is if they fit in uploadLimit, zero meaning no limit, whatever their dimensions.
+// Larger ones are flattened to their first frame and handled like other images.
+func PrepareAvatar(data []byte, maxSize int, uploadLimit int64) (*Avatar, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxAvatarSize
+	}
+
+	mimeType := http.DetectContentType(data)
+	flatten := false
+	if mimeType == "image/gif" {
+		if anim, err := gif.DecodeAll(bytes.NewReader(data)); err == nil && len(anim.Image) > 1 {
+			if uploadLimit <= 0 || int64(len(data)) <= uploadLimit {
+				return &Avatar{Data: data, MimeType: mimeType, Width: anim.Config.Width, Height: anim.Config.Height}, nil
+			}
+			flatten = true
+		}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		// clients can still display these, even if we can't decode them
+		if avatarTypes[mimeType] {
+			return &Avatar{Data: data, MimeType: mimeType}, nil
+		}
+
+		return nil, fmt.Errorf("%w %s", ErrUnsupportedImage, mimeType)
+	}
+
+	bounds := img.Bounds()
+	if !flatten && avatarTypes[mimeType] && bounds.Dx() <= maxSize && bounds.Dy() <= maxSize {
+		return &Avatar{Data: data, MimeType: mimeType, Width: bounds.Dx(), Height: bounds.Dy()}, nil
+	}
+
+	scaled := ScaleDown(img, maxSize)
+	var buf bytes.Buffer
+	if mimeType == "image/jpeg" {
+		err = jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: 90})
+	} else {
+		mimeType = "image/png"
+		err = png.Encode(&buf, scaled)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode avatar: %w", err)
+	}
+
+	return &Avatar{Data: buf.Bytes(), MimeType: mimeType, Width: scaled.Bounds().Dx(), Height: scaled.Bounds().Dy()}, nil
+}
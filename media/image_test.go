@@ -0,0 +1,130 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestScaleDown(t *testing.T) {
+	tests := []struct {
+		name                  string
+		width, height         int
+		maxSize               int
+		wantWidth, wantHeight int
+	}{
+		{"fits", 100, 50, 100, 100, 50},
+		{"exact fit", 100, 100, 100, 100, 100},
+		{"landscape", 400, 200, 100, 100, 50},
+		{"portrait", 200, 400, 100, 50, 100},
+		{"square", 300, 300, 100, 100, 100},
+		{"thin line keeps a pixel", 1000, 1, 100, 100, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := image.NewRGBA(image.Rect(0, 0, tt.width, tt.height))
+			got := ScaleDown(img, tt.maxSize).Bounds()
+
+			if got.Dx() != tt.wantWidth || got.Dy() != tt.wantHeight {
+				t.Fatalf("expected %dx%d, got %dx%d", tt.wantWidth, tt.wantHeight, got.Dx(), got.Dy())
+			}
+		})
+	}
+}
+
+func TestScaleDownOffsetBounds(t *testing.T) {
+	img := image.NewRGBA(image.Rect(10, 10, 210, 110))
+	img.Set(10, 10, image.White)
+
+	got := ScaleDown(img, 100)
+	if got.Bounds() != image.Rect(0, 0, 100, 50) {
+		t.Fatalf("unexpected bounds %v", got.Bounds())
+	}
+	if r, _, _, _ := got.At(0, 0).RGBA(); r != 0xffff {
+		t.Fatal("expected the top left pixel to be taken from the source bounds")
+	}
+}
+
+func encodeTestImage(t *testing.T, format string, width, height int) []byte {
+	t.Helper()
+
+	img := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{color.Black, color.White})
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	case "animated":
+		err = gif.EncodeAll(&buf, &gif.GIF{Image: []*image.Paletted{img, img}, Delay: []int{10, 10}})
+	}
+	if err != nil {
+		t.Fatalf("failed to encode %s: %v", format, err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestPrepareAvatar(t *testing.T) {
+	smallPNG := encodeTestImage(t, "png", 8, 8)
+	animated := encodeTestImage(t, "animated", 20, 10)
+	webp := []byte("RIFF\x00\x00\x00\x00WEBPVP8 not really a webp")
+
+	tests := []struct {
+		name        string
+		data        []byte
+		uploadLimit int64
+		wantType    string
+		wantWidth   int
+		wantHeight  int
+		wantSame    bool
+		wantErr     error
+	}{
+		{name: "small png is kept", data: smallPNG, wantType: "image/png", wantWidth: 8, wantHeight: 8, wantSame: true},
+		{name: "large png is scaled", data: encodeTestImage(t, "png", 40, 20), wantType: "image/png", wantWidth: 10, wantHeight: 5},
+		{name: "large jpeg stays jpeg", data: encodeTestImage(t, "jpeg", 20, 40), wantType: "image/jpeg", wantWidth: 5, wantHeight: 10},
+		{name: "large gif becomes png", data: encodeTestImage(t, "gif", 20, 20), wantType: "image/png", wantWidth: 10, wantHeight: 10},
+		{name: "animated gif is kept", data: animated, wantType: "image/gif", wantWidth: 20, wantHeight: 10, wantSame: true},
+		{name: "animated gif within limit is kept", data: animated, uploadLimit: int64(len(animated)), wantType: "image/gif", wantWidth: 20, wantHeight: 10, wantSame: true},
+		{name: "animated gif over limit is flattened", data: animated, uploadLimit: int64(len(animated)) - 1, wantType: "image/png", wantWidth: 10, wantHeight: 5},
+		{name: "undecodable known type is kept", data: webp, wantType: "image/webp", wantSame: true},
+		{name: "not an image", data: []byte("<html>not found</html>"), wantErr: ErrUnsupportedImage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PrepareAvatar(tt.data, 10, tt.uploadLimit)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got.MimeType != tt.wantType || got.Width != tt.wantWidth || got.Height != tt.wantHeight {
+				t.Fatalf("expected %s %dx%d, got %s %dx%d", tt.wantType, tt.wantWidth, tt.wantHeight, got.MimeType, got.Width, got.Height)
+			}
+			if tt.wantSame != bytes.Equal(got.Data, tt.data) {
+				t.Fatalf("expected data to be kept: %t", tt.wantSame)
+			}
+
+			if !tt.wantSame {
+				width, height, err := ImageSize(got.Data)
+				if err != nil || width != tt.wantWidth || height != tt.wantHeight {
+					t.Fatalf("expected encoded %dx%d, got %dx%d, %v", tt.wantWidth, tt.wantHeight, width, height, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.mau.fi/util/ffmpeg"
+	"maunium.net/go/mautrix/event"
+)
+
+// DetectMimeType sniffs the MIME type of the given data.
+// If the content can't be recognised, the file extension is used instead.
+func DetectMimeType(data []byte, fileName string) string {
+	mimeType := http.DetectContentType(data)
+	if mimeType != "application/octet-stream" {
+		return mimeType
+	}
+
+	if byExtension := mime.TypeByExtension(filepath.Ext(fileName)); byExtension != "" {
+		return byExtension
+	}
+
+	return mimeType
+}
+
+// MessageType returns the Matrix message type to use for a file with the given MIME type.
+func MessageType(mimeType string) event.MessageType {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return event.MsgImage
+	case strings.HasPrefix(mimeType, "video/"):
+		return event.MsgVideo
+	case strings.HasPrefix(mimeType, "audio/"):
+		return event.MsgAudio
+	default:
+		return event.MsgFile
+	}
+}
+
+// Probe returns the duration in milliseconds and the dimensions of an audio or video file.
+// This needs ffprobe to be installed, otherwise zero values are returned.
+func Probe(ctx context.Context, data []byte, fileName string) (duration, width, height int, err error) {
+	if !ffmpeg.ProbeSupported() {
+		return 0, 0, 0, nil
+	}
+
+	file, err := os.CreateTemp("", "bridgekit-*"+filepath.Ext(fileName))
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	_ = file.Close()
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to write temp file: %w", err)
+	}
+
+	result, err := ffmpeg.Probe(ctx, file.Name())
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if result.Format != nil {
+		duration = int(result.Format.Duration * 1000)
+	}
+	for _, stream := range result.Streams {
+		if stream.CodecType == "video" && stream.Width > 0 {
+			width, height = stream.Width, stream.Height
+			break
+		}
+	}
+
+	return duration, width, height, nil
+}